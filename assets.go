@@ -0,0 +1,52 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// defaultAssets contains the built-in theme, every file can be overridden for all domains by placing a file with the same name in BaseDir,
+// for all domains using a theme by placing it in BaseDir/themes/<theme> or for a single domain by placing it in BaseDir/<domain>, e.g. BaseDir/example.com/logo.png
+//
+//go:embed defaults
+var defaultAssets embed.FS
+
+// readAsset returns the asset name for domain, name is a slash separated path relative to the theme root, e.g. "css/shorter.css".
+// The first file found in BaseDir/<domain>/name, BaseDir/themes/<theme>/name, BaseDir/name and the built-in theme is used, source describes where the asset was found
+func readAsset(domain, name string) (data []byte, source string, err error) {
+	if config.BaseDir != "" {
+		paths := []string{filepath.Join(config.BaseDir, domain, filepath.FromSlash(name))}
+		if theme := themeFor(domain); theme != "" { // defined in themes.go
+			paths = append(paths, filepath.Join(config.BaseDir, "themes", theme, filepath.FromSlash(name)))
+		}
+		paths = append(paths, filepath.Join(config.BaseDir, filepath.FromSlash(name)))
+		for _, p := range paths {
+			data, err = ioutil.ReadFile(p)
+			if err == nil {
+				return data, p, nil
+			}
+			if !os.IsNotExist(err) {
+				return nil, p, err
+			}
+		}
+	}
+	data, err = fs.ReadFile(defaultAssets, path.Join("defaults", name))
+	return data, "built-in " + name, err
+}
+
+// initDomainDirs creates BaseDir/<domain> for every domain so that the backups can be written without any files on disk
+func initDomainDirs() {
+	for _, domain := range config.DomainNames {
+		if err := os.MkdirAll(filepath.Join(config.BaseDir, domain), 0755); err != nil {
+			log.Println("Unable to create the backup directory for", domain, err)
+			if logger != nil {
+				logger.Println("Unable to create the backup directory for", domain, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// atRestMagic starts every backup that is encrypted at rest, files without it are read as plaintext backups
+	atRestMagic = "shorter-enc-v1\n"
+	// atRestKeyIDLen is the length of the key id that identifies the master key a backup was encrypted with
+	atRestKeyIDLen = 8
+	// masterKeyLen is the length of the decoded EncryptionKey
+	masterKeyLen = 32
+)
+
+// masterKey is a decoded EncryptionKey or one of the EncryptionPreviousKeys
+type masterKey struct {
+	key []byte
+	id  []byte
+}
+
+var (
+	// currentMasterKey encrypts all backups, nil if encryption at rest is disabled
+	currentMasterKey *masterKey
+	// previousMasterKeys can only decrypt, backups encrypted with them are re-encrypted with currentMasterKey after startup
+	previousMasterKeys []*masterKey
+	// needsReencryption is set while restoring if any backup was plaintext or encrypted with a previous key
+	needsReencryption bool
+)
+
+// parseMasterKey decodes a base64 encoded 32 byte master key, both the standard and the url alphabet with or without padding are accepted
+func parseMasterKey(s string) (*masterKey, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != masterKeyLen {
+		return nil, fmt.Errorf("must be %d base64 encoded random bytes, e.g. the output of: head -c %d /dev/urandom | base64", masterKeyLen, masterKeyLen)
+	}
+	sum := sha256.Sum256(append([]byte("shorter key id\n"), key...))
+	return &masterKey{key: key, id: sum[:atRestKeyIDLen]}, nil
+}
+
+// parsePreviousKeys splits EncryptionPreviousKeys on commas and white space and decodes every key
+func parsePreviousKeys(s string) ([]*masterKey, error) {
+	var keys []*masterKey
+	for i, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+		k, err := parseMasterKey(field)
+		if err != nil {
+			return nil, fmt.Errorf("key %d %v", i+1, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// initEncryption decodes EncryptionKey and EncryptionPreviousKeys, call initEncryption before setupDB so that encrypted backups can be restored
+func initEncryption() error {
+	currentMasterKey, previousMasterKeys = nil, nil
+	if config.EncryptionKey == "" {
+		if config.EncryptionPreviousKeys != "" {
+			return errors.New("EncryptionPreviousKeys is set without EncryptionKey, set EncryptionKey to the new key")
+		}
+		return nil
+	}
+	k, err := parseMasterKey(config.EncryptionKey)
+	if err != nil {
+		return errors.New("EncryptionKey " + err.Error())
+	}
+	previous, err := parsePreviousKeys(config.EncryptionPreviousKeys)
+	if err != nil {
+		return errors.New("EncryptionPreviousKeys " + err.Error())
+	}
+	currentMasterKey, previousMasterKeys = k, previous
+	if logger != nil {
+		logger.Println("Encryption at rest enabled with", len(previous), "previous keys")
+	}
+	return nil
+}
+
+// dataKey derives the key used for the backups of domain from the master key k, every domain has its own key
+func (k *masterKey) dataKey(domain string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.key, nil, []byte("shorter data key\n"+domain)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// atRestAAD returns the additional authenticated data of an encrypted file, the header together with the domain and name of the file
+func atRestAAD(header []byte, domain, name string) []byte {
+	aad := append([]byte{}, header...)
+	return append(aad, domain+"/"+name...)
+}
+
+// isSealed returns true if data was encrypted by sealData
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(atRestMagic))
+}
+
+// sealData encrypts data with the data key of domain derived from currentMasterKey, name is authenticated so that an encrypted file can not
+// be swapped with another file. data is returned unchanged if encryption at rest is disabled
+func sealData(domain, name string, data []byte) ([]byte, error) {
+	if currentMasterKey == nil {
+		return data, nil
+	}
+	aead, err := currentMasterKey.dataKey(domain)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(atRestMagic), currentMasterKey.id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(out, nonce, data, atRestAAD(header, domain, name)), nil
+}
+
+// openData decrypts data created by sealData with the master key it was encrypted with, plaintext data is returned unchanged.
+// reencrypt is true if data should be saved again with currentMasterKey, i.e. it was plaintext or encrypted with a previous key
+func openData(domain, name string, data []byte) (plaintext []byte, reencrypt bool, err error) {
+	if !isSealed(data) {
+		return data, currentMasterKey != nil, nil
+	}
+	if currentMasterKey == nil {
+		return nil, false, errors.New(name + " is encrypted but no EncryptionKey is set, set EncryptionKey or EncryptionKeyFile to the key the backups were encrypted with")
+	}
+	headerLen := len(atRestMagic) + atRestKeyIDLen
+	if len(data) < headerLen {
+		return nil, false, errors.New(name + " is truncated")
+	}
+	id := data[len(atRestMagic):headerLen]
+	var k *masterKey
+	for _, candidate := range append([]*masterKey{currentMasterKey}, previousMasterKeys...) {
+		if bytes.Equal(candidate.id, id) {
+			k = candidate
+			break
+		}
+	}
+	if k == nil {
+		return nil, false, errors.New(name + " is encrypted with an unknown key, add the key it was encrypted with to EncryptionPreviousKeys")
+	}
+	aead, err := k.dataKey(domain)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) < headerLen+aead.NonceSize() {
+		return nil, false, errors.New(name + " is truncated")
+	}
+	header := data[:headerLen]
+	nonce := data[headerLen : headerLen+aead.NonceSize()]
+	plaintext, err = aead.Open(nil, nonce, data[headerLen+aead.NonceSize():], atRestAAD(header, domain, name))
+	if err != nil {
+		return nil, false, errors.New(name + " could not be decrypted, the file is corrupt or was modified")
+	}
+	return plaintext, k != currentMasterKey, nil
+}
+
+// reencryptBackups saves all backups again so that they are encrypted with currentMasterKey, started in the background after setupDB
+// if any backup was plaintext or encrypted with a previous key. The previous keys can be removed from the config once it has finished.
+// saveBackup serialises the writes of each LinkLen so links removed while it runs are not restored by an older snapshot
+func reencryptBackups() {
+	if logger != nil {
+		logger.Println("Re-encrypting all backups with the current EncryptionKey")
+	}
+	saveAllBackups() // defined in db.go
+	if logger != nil {
+		logger.Println("All backups are encrypted with the current EncryptionKey")
+	}
+}
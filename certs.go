@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval specifies how often the static certificate and key files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+// staticCert contains a loaded certificate together with the modification times of the files it was loaded from
+type staticCert struct {
+	conf    CertificateConfig
+	names   []string
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// certStore contains all static certificates specified in config.Certificates
+type certStore struct {
+	mutex sync.RWMutex
+	certs []*staticCert
+}
+
+// loadStaticCertificates loads all certificates in config.Certificates and starts a goroutine that reloads them when the files change on disk
+func loadStaticCertificates() (*certStore, error) {
+	store := &certStore{}
+	for _, conf := range config.Certificates {
+		sc := &staticCert{conf: conf}
+		if err := sc.load(); err != nil {
+			return nil, err
+		}
+		store.certs = append(store.certs, sc)
+	}
+	if len(store.certs) > 0 {
+		go store.reloadRoutine()
+	}
+	return store, nil
+}
+
+// load reads the certificate and key files of sc, note that sc is only modified if the new certificate is valid
+func (sc *staticCert) load() error {
+	certInfo, err := os.Stat(sc.conf.CertFile)
+	if err != nil {
+		return errors.New("unable to read CertFile " + sc.conf.CertFile + ": " + err.Error())
+	}
+	keyInfo, err := os.Stat(sc.conf.KeyFile)
+	if err != nil {
+		return errors.New("unable to read KeyFile " + sc.conf.KeyFile + ": " + err.Error())
+	}
+	cert, err := tls.LoadX509KeyPair(sc.conf.CertFile, sc.conf.KeyFile)
+	if err != nil {
+		return errors.New("invalid certificate " + sc.conf.CertFile + " or key " + sc.conf.KeyFile + ": " + err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.New("unable to parse certificate " + sc.conf.CertFile + ": " + err.Error())
+	}
+	cert.Leaf = leaf
+
+	// use the names in the certificate if no Domains are specified in the config
+	names := sc.conf.Domains
+	if len(names) == 0 {
+		names = leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+	}
+	sc.names = nil
+	for _, name := range names {
+		sc.names = append(sc.names, strings.ToLower(hostWithoutPort(name)))
+	}
+	sc.cert = &cert
+	sc.certMod = certInfo.ModTime()
+	sc.keyMod = keyInfo.ModTime()
+	for _, name := range sc.names {
+		recordCertificate(name, "static", sc.cert) // defined in letsencrypt.go
+	}
+	if logger != nil {
+		logger.Println("Loaded certificate", sc.conf.CertFile, "for", sc.names, "valid until", leaf.NotAfter.UTC().Format(dateFormat))
+	}
+	return nil
+}
+
+// changed returns true if the certificate or key file has been modified since sc was loaded
+func (sc *staticCert) changed() bool {
+	certInfo, err := os.Stat(sc.conf.CertFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(sc.conf.KeyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(sc.certMod) || !keyInfo.ModTime().Equal(sc.keyMod)
+}
+
+// matches returns true if sc is valid for the host name, wildcard names only match a single label
+func (sc *staticCert) matches(name string) bool {
+	for _, n := range sc.names {
+		if n == name {
+			return true
+		}
+		if strings.HasPrefix(n, "*.") {
+			if i := strings.IndexByte(name, '.'); i > 0 && name[i:] == n[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reloadRoutine checks for modified certificate and key files every certReloadInterval. If a changed certificate fails to load the old certificate is kept,
+// this allows the files to be replaced one at a time.
+func (s *certStore) reloadRoutine() {
+	for {
+		time.Sleep(certReloadInterval)
+		s.mutex.Lock()
+		for _, sc := range s.certs {
+			if !sc.changed() {
+				continue
+			}
+			if err := sc.load(); err != nil {
+				for _, name := range sc.names {
+					recordCertificateError(name, "static", errors.New("failed to reload, keeping the previous certificate: "+err.Error()))
+				}
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// getCertificate returns the static certificate matching the SNI of hello or nil if no static certificate is configured for the name
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	if s == nil {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, sc := range s.certs {
+		if sc.matches(name) {
+			return sc.cert
+		}
+	}
+	return nil
+}
+
+// covers returns true if any static certificate is valid for the host name
+func (s *certStore) covers(name string) bool {
+	return s.getCertificate(&tls.ClientHelloInfo{ServerName: name}) != nil
+}
+
+// hostWithoutPort strips the optional port from a host, e.g. "localhost:8080" becomes "localhost"
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
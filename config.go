@@ -0,0 +1,559 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// envPrefix is the prefix of all environment variables that override config fields
+	envPrefix = "SHORTER_"
+	// redactedValue replaces secrets when the config is shown or logged
+	redactedValue = "<redacted>"
+)
+
+var (
+	// placeholderSecrets contains the example values for LogSep, Salt and HashSHA256 from the shipped config, including the values
+	// of earlier versions of the config
+	placeholderSecrets = map[string]bool{
+		"XXXXXXXXXXXXXXXX":                           true,
+		"hex encoded SHA256 hash of Password + Salt": true,
+		"set LogSep to a random value, suggested 16 random characters from charset a-z A-Z 0-9":   true,
+		"set salt to a random value, suggested 16 random characters":                              true,
+		"set this to the SHA256 hash of Password + Salt (sha256.Sum256([]byte(password + salt)))": true,
+	}
+
+	// cspDirectives contains all valid Content-Security-Policy directive names
+	cspDirectives = map[string]bool{
+		"default-src": true, "script-src": true, "script-src-elem": true, "script-src-attr": true, "style-src": true, "style-src-elem": true,
+		"style-src-attr": true, "img-src": true, "font-src": true, "connect-src": true, "media-src": true, "object-src": true, "frame-src": true,
+		"child-src": true, "worker-src": true, "manifest-src": true, "prefetch-src": true, "base-uri": true, "form-action": true,
+		"frame-ancestors": true, "sandbox": true, "report-uri": true, "report-to": true, "upgrade-insecure-requests": true,
+		"block-all-mixed-content": true, "require-trusted-types-for": true, "trusted-types": true,
+	}
+
+	// cspKeywords contains all valid quoted Content-Security-Policy source keywords, nonces and hashes are checked separately
+	cspKeywords = map[string]bool{
+		"'self'": true, "'none'": true, "'unsafe-inline'": true, "'unsafe-eval'": true, "'strict-dynamic'": true,
+		"'unsafe-hashes'": true, "'report-sample'": true, "'wasm-unsafe-eval'": true, "'unsafe-allow-redirects'": true, "'script'": true,
+	}
+)
+
+// parseConfig parses a config file, applies the SHORTER_ environment variables, reads the secret files and sets the default values for optional fields
+func parseConfig(conf []byte) (Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(conf, &c); err != nil {
+		return c, fmt.Errorf("Unable to parse config file:\n %v", err)
+	}
+	if err := applyEnvOverrides(&c); err != nil {
+		return c, err
+	}
+	if err := loadSecretFiles(&c); err != nil {
+		return c, err
+	}
+	if c.TLSProfile == "" {
+		c.TLSProfile = "intermediate"
+	}
+
+	// if BaseDir is not specified in the config the directory shorterdata in the current directory is used, it is created if it does not exist
+	if c.BaseDir == "" {
+		c.BaseDir = filepath.Join(".", "shorterdata")
+	}
+	return c, nil
+}
+
+// checkConfigCommand implements shorter check-config <file>, it returns the exit code
+func checkConfigCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: shorter check-config /path/to/config")
+		return 2
+	}
+	c, err := loadConfigFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	errs := validateConfig(&c)
+	// checkHSTSPreload reads the global config
+	config = c
+	for _, warning := range checkHSTSPreload() { // defined in letsencrypt.go
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if c.HashSHA256 != "" {
+		fmt.Fprintln(os.Stderr, "warning:", errLegacyAdminHash)
+	}
+	if len(errs) > 0 {
+		printConfigErrors(os.Stderr, errs)
+		return 1
+	}
+	fmt.Println(args[0] + ": OK")
+	return 0
+}
+
+// showConfigCommand implements shorter show-config <file>, it prints the effective config after applying the environment variables and secret files with all secrets redacted
+func showConfigCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: shorter show-config /path/to/config")
+		return 2
+	}
+	c, err := loadConfigFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(redactedConfig(c))
+	return 0
+}
+
+// loadConfigFile reads and parses the config file at path
+func loadConfigFile(path string) (Config, error) {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("Invalid config file:\n %v", err)
+	}
+	return parseConfig(conf)
+}
+
+// applyEnvOverrides replaces every field of c that has a matching SHORTER_<FIELD> environment variable, where FIELD is the upper case yaml name of the field,
+// e.g. SHORTER_CLEAR1DURATION=24h or SHORTER_DOMAINNAMES='["example.com", "www.example.com"]'. Strings are used as is and all other values are parsed as YAML.
+// SHORTER_<FIELD>_FILE reads the value from a file instead, e.g. SHORTER_SALT_FILE=/run/secrets/salt
+func applyEnvOverrides(c *Config) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			continue
+		}
+		env := envPrefix + strings.ToUpper(name)
+		value, ok := os.LookupEnv(env)
+		if file, fileOk := os.LookupEnv(env + "_FILE"); fileOk {
+			if ok {
+				return fmt.Errorf("Both %s and %s_FILE are set, please only use one of them", env, env)
+			}
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("Unable to read %s_FILE:\n %v", env, err)
+			}
+			value, ok = strings.TrimRight(string(b), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			continue
+		}
+		parsed := reflect.New(field.Type())
+		if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+			return fmt.Errorf("Unable to parse %s:\n %v", env, err)
+		}
+		field.Set(parsed.Elem())
+	}
+	return nil
+}
+
+// loadSecretFiles reads the secrets specified with LogSepFile, SaltFile, HashSHA256File, ACMEEABHMACKeyFile and the Encryption*File fields, a trailing newline is removed
+func loadSecretFiles(c *Config) error {
+	secrets := []struct {
+		name  string
+		file  string
+		value *string
+	}{
+		{"LogSep", c.LogSepFile, &c.LogSep},
+		{"Salt", c.SaltFile, &c.Salt},
+		{"HashSHA256", c.HashSHA256File, &c.HashSHA256},
+		{"ACMEEABHMACKey", c.ACMEEABHMACKeyFile, &c.ACMEEABHMACKey},
+		{"EncryptionKey", c.EncryptionKeyFile, &c.EncryptionKey},
+		{"EncryptionPreviousKeys", c.EncryptionPreviousKeysFile, &c.EncryptionPreviousKeys},
+	}
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("Both %s and %sFile are set, please only use one of them", secret.name, secret.name)
+		}
+		b, err := ioutil.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("Unable to read %sFile:\n %v", secret.name, err)
+		}
+		*secret.value = strings.TrimRight(string(b), "\r\n")
+	}
+	return nil
+}
+
+// redactedConfig returns c as YAML where all non empty fields tagged with secret:"true" are replaced with redactedValue
+func redactedConfig(c Config) string {
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString(redactedValue)
+		}
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return "Unable to marshal config: " + err.Error() + "\n"
+	}
+	return string(out)
+}
+
+// printConfigErrors writes one line per error to w
+func printConfigErrors(w io.Writer, errs []string) {
+	for _, err := range errs {
+		fmt.Fprintln(w, "config error:", err)
+	}
+	fmt.Fprintf(w, "%d config error(s) found, see shorterdata/config for an example of a valid config\n", len(errs))
+}
+
+// validateConfig checks all fields of c and returns an actionable error message for every invalid field
+func validateConfig(c *Config) (errs []string) {
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	// Domains and directories
+	if info, err := os.Stat(c.BaseDir); err == nil && !info.IsDir() {
+		add("BaseDir %q is not a directory", c.BaseDir)
+	}
+	if len(c.DomainNames) == 0 {
+		add("DomainNames must contain at least one domain, e.g. \"example.com\"")
+	}
+	domains := make(map[string]bool)
+	for _, domain := range c.DomainNames {
+		if domain == "" || strings.ContainsAny(domain, "/\\ ") || domain == "." || domain == ".." {
+			add("DomainNames contains the invalid domain %q, use the host name and optional port, e.g. \"example.com\" or \"localhost:8080\"", domain)
+			continue
+		}
+		if domains[domain] {
+			add("DomainNames contains %q more than once", domain)
+		}
+		domains[domain] = true
+		if info, err := os.Stat(filepath.Join(c.BaseDir, domain)); err == nil && !info.IsDir() {
+			add("%q must be a directory, it is used for the backups and theme overrides of domain %q", filepath.Join(c.BaseDir, domain), domain)
+		}
+	}
+	for domain := range c.Domains {
+		if !domains[domain] {
+			add("Domains contains settings for %q which is not listed in DomainNames", domain)
+		}
+	}
+
+	// Timeouts and limits
+	durations := []struct {
+		name  string
+		value interface{ Seconds() float64 }
+	}{
+		{"Clear1Duration", c.Clear1Duration},
+		{"Clear2Duration", c.Clear2Duration},
+		{"Clear3Duration", c.Clear3Duration},
+		{"ClearCustomLinksDuration", c.ClearCustomLinksDuration},
+	}
+	for _, d := range durations {
+		if d.value.Seconds() <= 0 {
+			add("%s must be a positive duration such as \"24h\" or \"30m\", got %v", d.name, d.value)
+		}
+	}
+	if c.MaxFileSize <= 0 {
+		add("MaxFileSize must be a positive number of bytes, e.g. 10000000 for 10MB")
+	}
+	if c.MaxRAM == 0 {
+		add("MaxRAM must be a positive number of bytes, e.g. 1000000000 for 1GB, otherwise all new text links are rejected")
+	}
+	if c.MaxCustomLinks < 0 {
+		add("MaxCustomLinks can not be negative")
+	}
+	if c.LinkAccessMaxNr < 0 {
+		add("LinkAccessMaxNr can not be negative")
+	}
+	validateRateLimits(add, "RateLimits", c.RateLimits)
+	for domain, domainConf := range c.Domains {
+		if domainConf.RateLimits != nil {
+			validateRateLimits(add, "Domains."+domain+".RateLimits", *domainConf.RateLimits)
+		}
+	}
+
+	// Listeners
+	if len(c.Listeners) == 0 {
+		validateAddressPort(add, "AddressPort", c.AddressPort)
+		if !c.NoTLS {
+			validateAddressPort(add, "TLSAddressPort", c.TLSAddressPort)
+		}
+	}
+	for i, lc := range c.Listeners {
+		name := fmt.Sprintf("Listeners[%d]", i)
+		switch lc.Network {
+		case "", "tcp", "tcp4", "tcp6":
+			validateAddressPort(add, name+".Address", lc.Address)
+		case "unix":
+			if lc.Address == "" {
+				add("%s.Address must be the path of the unix socket", name)
+			}
+			if lc.SocketMode != "" {
+				if _, err := strconv.ParseUint(lc.SocketMode, 8, 32); err != nil {
+					add("%s.SocketMode %q must be in octal notation, e.g. \"0660\"", name, lc.SocketMode)
+				}
+			}
+		case "systemd":
+		default:
+			add("%s.Network %q is invalid, valid values are tcp, tcp4, tcp6, unix and systemd", name, lc.Network)
+		}
+		switch lc.Serve {
+		case "", "http":
+		case "https", "redirect":
+			if c.NoTLS {
+				add("%s.Serve %q requires NoTLS to be false", name, lc.Serve)
+			}
+		default:
+			add("%s.Serve %q is invalid, valid values are http, https and redirect", name, lc.Serve)
+		}
+	}
+	// Netcat listener, defined in netcat.go
+	if c.Netcat.Address != "" {
+		validateAddressPort(add, "Netcat.Address", c.Netcat.Address)
+		if c.Netcat.Domain != "" && !domains[c.Netcat.Domain] {
+			add("Netcat.Domain %q is not listed in DomainNames", c.Netcat.Domain)
+		}
+		if c.Netcat.IdleTimeout < 0 || c.Netcat.ReadTimeout < 0 {
+			add("Netcat.IdleTimeout and Netcat.ReadTimeout can not be negative")
+		}
+		if c.Netcat.MaxConnections < 0 {
+			add("Netcat.MaxConnections can not be negative")
+		}
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil { // defined in proxy.go
+			add("TrustedProxies contains %q which is neither an IP address nor a CIDR network such as \"10.0.0.0/8\"", proxy)
+		}
+	}
+
+	// TLS
+	if !c.NoTLS {
+		if _, ok := tlsProfiles[c.TLSProfile]; !ok {
+			add("TLSProfile %q is invalid, valid profiles are modern and intermediate", c.TLSProfile)
+		}
+		for i, cert := range c.Certificates {
+			if _, err := os.Stat(cert.CertFile); err != nil {
+				add("Certificates[%d].CertFile %q can not be read: %v", i, cert.CertFile, err)
+			}
+			if _, err := os.Stat(cert.KeyFile); err != nil {
+				add("Certificates[%d].KeyFile %q can not be read: %v", i, cert.KeyFile, err)
+			}
+		}
+		if c.ACMEDirectoryURL != "" {
+			if u, err := url.Parse(c.ACMEDirectoryURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				add("ACMEDirectoryURL %q must be an https URL", c.ACMEDirectoryURL)
+			}
+		}
+		if c.ACMEEABKeyID != "" {
+			if key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(c.ACMEEABHMACKey, "=")); err != nil || len(key) == 0 {
+				add("ACMEEABHMACKey must be set to the base64url encoded HMAC key provided by the CA when ACMEEABKeyID is set")
+			}
+		}
+	}
+	// Encryption at rest, defined in atrest.go
+	if c.EncryptionKey != "" {
+		if _, err := parseMasterKey(c.EncryptionKey); err != nil {
+			add("EncryptionKey %v", err)
+		}
+	}
+	if c.EncryptionPreviousKeys != "" {
+		if c.EncryptionKey == "" {
+			add("EncryptionPreviousKeys can only be used together with EncryptionKey")
+		}
+		if _, err := parsePreviousKeys(c.EncryptionPreviousKeys); err != nil {
+			add("EncryptionPreviousKeys %v", err)
+		}
+	}
+	if c.HSTS != "" && c.NoTLS {
+		add("HSTS can only be used if NoTLS is false, remove HSTS or set NoTLS to false")
+	}
+	if c.H2C && !c.NoTLS {
+		add("H2C is only used without TLS, remove H2C or set NoTLS to true")
+	}
+
+	// Themes
+	validateTheme(add, c, "", c.Theme, c.ThemeVars)
+	for domain, domainConf := range c.Domains {
+		validateTheme(add, c, "Domains."+domain+".", domainConf.Theme, domainConf.ThemeVars)
+	}
+
+	// Redirects
+	validateRedirect(add, "", c.RedirectMode, c.RedirectStatus, c.CountdownSeconds)
+	for domain, domainConf := range c.Domains {
+		validateRedirect(add, "Domains."+domain+".", domainConf.RedirectMode, domainConf.RedirectStatus, domainConf.CountdownSeconds)
+	}
+
+	// Localization
+	validateLocale(add, "", c.Language, c.TimeZone)
+	for domain, domainConf := range c.Domains {
+		validateLocale(add, "Domains."+domain+".", domainConf.Language, domainConf.TimeZone)
+	}
+
+	// Headers
+	if c.CSP != "" {
+		for _, err := range validateCSP(c.CSP) {
+			add("CSP %s", err)
+		}
+	}
+
+	// Secrets
+	if c.Logging && (c.LogSep == "" || isPlaceholder(c.LogSep)) {
+		add("LogSep must be set to a secret random value when Logging is true, e.g. 16 random characters from a-z A-Z 0-9")
+	}
+	if isPlaceholder(c.Salt) {
+		add("Salt is still set to the example value, set it to a secret random value")
+	}
+	if c.HashSHA256 != "" {
+		if isPlaceholder(c.HashSHA256) {
+			add("HashSHA256 is still set to the example value, set it to the SHA256 hash of your password + Salt or remove it to disable special requests")
+		} else if b, err := hex.DecodeString(c.HashSHA256); err != nil || len(b) != 32 {
+			add("HashSHA256 must be a hex encoded SHA256 hash (64 characters)")
+		} else if c.Salt == "" {
+			add("Salt must be set when HashSHA256 is set")
+		}
+	}
+
+	if c.CredentialsFile != "" {
+		if _, err := os.Stat(c.CredentialsFile); err != nil {
+			add("CredentialsFile %q can not be read, create it with shorter passwd -file %s name", c.CredentialsFile, c.CredentialsFile)
+		} else if _, err := readCredentialsFile(c.CredentialsFile); err != nil { // defined in credentials.go
+			add("CredentialsFile %v", err)
+		}
+	}
+
+	// Static links
+	for key, link := range c.StaticLinks {
+		if key == "" || !validate(key) {
+			add("StaticLinks key %q may only contain the characters %s", key, customKeyCharset)
+		}
+		if !validURL(link) {
+			add("StaticLinks %q points to %q which is not a valid http:// or https:// URL", key, link)
+		}
+	}
+	return errs
+}
+
+// isPlaceholder returns true if s is one of the example values from the shipped config
+func isPlaceholder(s string) bool {
+	return placeholderSecrets[s]
+}
+
+func validateAddressPort(add func(string, ...interface{}), name, addressPort string) {
+	_, port, err := net.SplitHostPort(addressPort)
+	if err != nil {
+		add("%s %q must be an address and port such as \"127.0.0.1:8080\" or \":443\"", name, addressPort)
+		return
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			add("%s %q has an invalid port", name, addressPort)
+		}
+	}
+}
+
+func validateTheme(add func(string, ...interface{}), c *Config, prefix, theme string, vars ThemeVars) {
+	if theme != "" {
+		if strings.ContainsAny(theme, "/\\") || theme == "." || theme == ".." {
+			add("%sTheme %q is invalid, use the name of a directory in BaseDir/themes", prefix, theme)
+		} else if info, err := os.Stat(filepath.Join(c.BaseDir, "themes", theme)); err != nil || !info.IsDir() {
+			add("%sTheme %q does not exist, create the directory %q", prefix, theme, filepath.Join(c.BaseDir, "themes", theme))
+		}
+	}
+	colors := map[string]string{"Primary": vars.Colors.Primary, "Background": vars.Colors.Background, "Surface": vars.Colors.Surface, "Text": vars.Colors.Text, "Error": vars.Colors.Error}
+	for name, color := range colors {
+		if strings.ContainsAny(color, ";{}<>\"'\\") {
+			add("%sThemeVars.Colors.%s %q is not a valid css color, use e.g. \"#209cee\" or \"rgb(32, 156, 238)\"", prefix, name, color)
+		}
+	}
+}
+
+func validateRedirect(add func(string, ...interface{}), prefix, mode string, status, countdown int) {
+	if mode != "" && !validRedirectModes[mode] {
+		add("%sRedirectMode %q is invalid, valid modes are direct, interstitial and countdown", prefix, mode)
+	}
+	if status != 0 && status != http.StatusFound && status != http.StatusTemporaryRedirect {
+		add("%sRedirectStatus %d is invalid, use 302 or 307", prefix, status)
+	}
+	if countdown < 0 {
+		add("%sCountdownSeconds can not be negative", prefix)
+	}
+}
+
+func validateLocale(add func(string, ...interface{}), prefix, lang, tz string) {
+	if lang != "" {
+		if _, err := language.Parse(lang); err != nil {
+			add("%sLanguage %q is not a valid language tag, use e.g. \"en\", \"sv\" or \"pt-BR\"", prefix, lang)
+		}
+	}
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			add("%sTimeZone %q is not a valid IANA time zone, use e.g. \"UTC\" or \"Europe/Stockholm\"", prefix, tz)
+		}
+	}
+}
+
+func validateRateLimits(add func(string, ...interface{}), name string, limits RateLimits) {
+	budgets := map[string]RateLimit{"Create": limits.Create, "Lookup": limits.Lookup, "FailedLookup": limits.FailedLookup, "AdminLogin": limits.AdminLogin}
+	for budget, limit := range budgets {
+		if limit.Rate < 0 || limit.Burst < 0 || limit.Per < 0 {
+			add("%s.%s can not contain negative values", name, budget)
+		}
+	}
+}
+
+// validateCSP checks the syntax of a Content-Security-Policy, ###DomainNames### is replaced with a valid host before checking
+func validateCSP(csp string) (errs []string) {
+	seen := make(map[string]bool)
+	for _, directive := range strings.Split(strings.ReplaceAll(csp, "###DomainNames###", "example.com"), ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if !cspDirectives[name] {
+			errs = append(errs, fmt.Sprintf("contains the unknown directive %q", fields[0]))
+			continue
+		}
+		if seen[name] {
+			errs = append(errs, fmt.Sprintf("contains the directive %q more than once, browsers ignore all but the first", name))
+		}
+		seen[name] = true
+		if name == "report-uri" || name == "report-to" || name == "sandbox" || name == "trusted-types" || name == "require-trusted-types-for" {
+			continue
+		}
+		for _, source := range fields[1:] {
+			if strings.HasPrefix(source, "'") {
+				lower := strings.ToLower(source)
+				if !strings.HasSuffix(source, "'") || len(source) < 3 {
+					errs = append(errs, fmt.Sprintf("directive %q has an unterminated quote in %q", name, source))
+				} else if !cspKeywords[lower] && !strings.HasPrefix(lower, "'nonce-") && !strings.HasPrefix(lower, "'sha256-") && !strings.HasPrefix(lower, "'sha384-") && !strings.HasPrefix(lower, "'sha512-") {
+					errs = append(errs, fmt.Sprintf("directive %q contains the unknown keyword %s", name, source))
+				}
+				if lower == "'none'" && len(fields) > 2 {
+					errs = append(errs, fmt.Sprintf("directive %q combines 'none' with other sources", name))
+				}
+			} else if strings.ContainsAny(source, "'\",") {
+				errs = append(errs, fmt.Sprintf("directive %q contains the invalid source %q", name, source))
+			}
+		}
+	}
+	return errs
+}
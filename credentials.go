@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// argon2id parameters for new password hashes, verification uses the parameters stored in each hash
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+	// maxConcurrentHashes limits the number of argon2id hashes computed at the same time, each hash uses argon2Memory KiB so parallel
+	// requests for password protected links or admin views can not use an unbounded amount of RAM
+	maxConcurrentHashes = 4
+
+	// roleAdmin grants access to all admin views
+	roleAdmin = "admin"
+	// roleLinks grants access to the list of active links, listactive~
+	roleLinks = "links"
+	// roleCerts grants access to the certificate status view, certstatus~
+	roleCerts = "certs"
+)
+
+var (
+	// validRoles contains all roles that can be assigned to a credential
+	validRoles = map[string]bool{roleAdmin: true, roleLinks: true, roleCerts: true}
+	// credentials contains the admin credentials loaded from config.CredentialsFile, should be used as read only after loadCredentials() has returned
+	credentials []Credential
+	// hashSlots is a semaphore with maxConcurrentHashes slots, use argon2IDKey to compute a hash
+	hashSlots = make(chan struct{}, maxConcurrentHashes)
+	// errHashBusy is returned by tryHashPassword if no hash slot is free
+	errHashBusy = errors.New("all hash slots are in use")
+)
+
+// CredentialsFile is the content of the file specified by config.CredentialsFile
+type CredentialsFile struct {
+	Credentials []Credential `yaml:"Credentials"`
+}
+
+// Credential is a named admin credential, Hash is an argon2id hash in the PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+type Credential struct {
+	Name  string   `yaml:"Name"`
+	Roles []string `yaml:"Roles"`
+	Hash  string   `yaml:"Hash"`
+}
+
+// hasRole returns true if c has role or is an admin
+func (c Credential) hasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role || r == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// readCredentialsFile reads and validates a credentials file, a missing file is treated as an empty file
+func readCredentialsFile(path string) (CredentialsFile, error) {
+	var cf CredentialsFile
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cf, nil
+	} else if err != nil {
+		return cf, err
+	}
+	if err := yaml.UnmarshalStrict(b, &cf); err != nil {
+		return cf, fmt.Errorf("Unable to parse credentials file %s:\n %v", path, err)
+	}
+	names := make(map[string]bool)
+	for _, c := range cf.Credentials {
+		if c.Name == "" {
+			return cf, fmt.Errorf("credentials file %s contains a credential without a Name", path)
+		}
+		if names[c.Name] {
+			return cf, fmt.Errorf("credentials file %s contains %q more than once", path, c.Name)
+		}
+		names[c.Name] = true
+		for _, role := range c.Roles {
+			if !validRoles[role] {
+				return cf, fmt.Errorf("credential %q has the invalid role %q, valid roles are admin, links and certs", c.Name, role)
+			}
+		}
+		if _, _, _, err := parseArgon2Hash(c.Hash); err != nil {
+			return cf, fmt.Errorf("credential %q has an invalid Hash: %v", c.Name, err)
+		}
+	}
+	return cf, nil
+}
+
+// writeCredentialsFile replaces the credentials file at path, the file is only readable by the owner
+func writeCredentialsFile(path string, cf CredentialsFile) error {
+	b, err := yaml.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadCredentials loads config.CredentialsFile and logs a deprecation warning if the legacy Salt and HashSHA256 are used
+func loadCredentials() error {
+	if config.CredentialsFile != "" {
+		cf, err := readCredentialsFile(config.CredentialsFile)
+		if err != nil {
+			return err
+		}
+		credentials = cf.Credentials
+	}
+	if config.HashSHA256 != "" {
+		log.Println("Warning:", errLegacyAdminHash)
+		if logger != nil {
+			logger.Println("Warning:", errLegacyAdminHash)
+		}
+	}
+	return nil
+}
+
+// hashPassword returns an argon2id hash of password with a random salt in the PHC string format
+func hashPassword(password string) (string, error) {
+	return newPasswordHash(password, true)
+}
+
+// tryHashPassword is hashPassword for anonymous requests, it does not wait for a free hash slot so that new links with a password can not
+// delay unlocks and admin logins of other clients. errHashBusy is returned if all hashSlots are in use
+func tryHashPassword(password string) (string, error) {
+	return newPasswordHash(password, false)
+}
+
+// newPasswordHash returns an argon2id hash of password, if wait is false errHashBusy is returned instead of waiting for a free hash slot
+func newPasswordHash(password string, wait bool) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	if wait {
+		hashSlots <- struct{}{}
+	} else {
+		select {
+		case hashSlots <- struct{}{}:
+		default:
+			return "", errHashBusy
+		}
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	<-hashSlots
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// argon2IDKey computes an argon2id key once one of the hashSlots is free, requests wait for a slot instead of computing more hashes in parallel
+func argon2IDKey(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
+
+// argon2Params contains the parameters stored in an argon2id hash
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// parseArgon2Hash parses an argon2id hash in the PHC string format
+func parseArgon2Hash(hash string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("not an argon2id hash, use shorter passwd to generate a hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil || params.time == 0 || params.threads == 0 {
+		return params, nil, nil, errors.New("invalid argon2 parameters")
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, errors.New("invalid salt encoding")
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid hash encoding")
+	}
+	return params, salt, key, nil
+}
+
+// verifyPassword returns true if password matches the argon2id hash
+func verifyPassword(password, hash string) bool {
+	params, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// authorizeAdmin returns the name of the credential that matches pwd and has role, if no credential matches ok is false.
+// The legacy Salt and HashSHA256 are accepted as an admin credential named "legacy" until they are removed from the config
+func authorizeAdmin(pwd, role string) (name string, ok bool) {
+	if pwd == "" {
+		return "", false
+	}
+	for _, c := range credentials {
+		if c.hasRole(role) && verifyPassword(pwd, c.Hash) {
+			return c.Name, true
+		}
+	}
+	if config.HashSHA256 != "" && validAdminPassword(pwd) { // defined in misc.go
+		return "legacy", true
+	}
+	return "", false
+}
+
+// passwdCommand implements shorter passwd, it prompts for a password and adds or replaces the named credential in a credentials file.
+// If no credentials file is specified the credential is printed so that it can be added to a credentials file manually
+func passwdCommand(args []string) int {
+	flags := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	file := flags.String("file", "", "path to the credentials file to update, if not set the credential is printed")
+	roles := flags.String("roles", roleAdmin, "comma separated list of roles, valid roles are admin, links and certs")
+	remove := flags.Bool("delete", false, "remove the credential from the credentials file instead of setting a password")
+	list := flags.Bool("list", false, "list the credentials in the credentials file")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: shorter passwd [-file credentials] [-roles admin,links,certs] [-delete] name\n       shorter passwd -file credentials -list")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *list {
+		if *file == "" {
+			flags.Usage()
+			return 2
+		}
+		cf, err := readCredentialsFile(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, c := range cf.Credentials {
+			fmt.Println(c.Name, strings.Join(c.Roles, ","))
+		}
+		return 0
+	}
+	if flags.NArg() != 1 || (*remove && *file == "") {
+		flags.Usage()
+		return 2
+	}
+	name := flags.Arg(0)
+
+	var cf CredentialsFile
+	if *file != "" {
+		var err error
+		if cf, err = readCredentialsFile(*file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	// remove any existing credential with the same name, it is replaced below unless -delete is set
+	found := false
+	for i, c := range cf.Credentials {
+		if c.Name == name {
+			cf.Credentials = append(cf.Credentials[:i], cf.Credentials[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if *remove {
+		if !found {
+			fmt.Fprintln(os.Stderr, "No credential named", name, "in", *file)
+			return 1
+		}
+		if err := writeCredentialsFile(*file, cf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Removed", name, "from", *file)
+		return 0
+	}
+
+	cred := Credential{Name: name, Roles: strings.Split(*roles, ",")}
+	for _, role := range cred.Roles {
+		if !validRoles[role] {
+			fmt.Fprintln(os.Stderr, "Invalid role", role+", valid roles are admin, links and certs")
+			return 2
+		}
+	}
+	password, err := promptPassword()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cred.Hash, err = hashPassword(password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cf.Credentials = append(cf.Credentials, cred)
+
+	if *file == "" {
+		b, _ := yaml.Marshal(CredentialsFile{Credentials: []Credential{cred}})
+		fmt.Print(string(b))
+		return 0
+	}
+	if err := writeCredentialsFile(*file, cf); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Updated", name, "in", *file)
+	return 0
+}
+
+// promptPassword reads a password twice from the terminal without echo, if stdin is not a terminal a single line is read so that passwords can be piped
+func promptPassword() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		// a missing trailing newline is accepted
+		password, _ := reader.ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return "", errors.New("no password was provided on stdin")
+		}
+		return password, nil
+	}
+
+	// stty is not available on all platforms, in that case the password is echoed
+	echoOff := exec.Command("stty", "-echo")
+	echoOff.Stdin = os.Stdin
+	if echoOff.Run() == nil {
+		defer func() {
+			echoOn := exec.Command("stty", "echo")
+			echoOn.Stdin = os.Stdin
+			echoOn.Run()
+		}()
+	}
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := reader.ReadString('\n')
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	password, err := read("Password: ")
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("the password can not be empty")
+	}
+	again, err := read("Repeat password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != again {
+		return "", errors.New("the passwords do not match")
+	}
+	return password, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"time"
@@ -21,6 +22,10 @@ func setupDB() {
 		restoreLinkLen(&domainLinkLens[domain].LinkLen3, "len3", domain)
 		restoreLinkLen(&domainLinkLens[domain].LinkCustom, "custom", domain)
 	}
+	if needsReencryption {
+		go reencryptBackups() // defined in atrest.go
+	}
+	setReady(&readiness.linkLensRestored) // defined in health.go
 }
 
 func restoreLinkLen(l *LinkLen, typ, domain string) {
@@ -30,7 +35,15 @@ func restoreLinkLen(l *LinkLen, typ, domain string) {
 	d, err := ioutil.ReadFile(filepath.Join(config.BaseDir, domain, fileName))
 	if err != nil && logger != nil {
 		logger.Println(err, "ReadFile - Skipping "+fileName)
-	} else {
+	} else if err == nil {
+		// a backup that can not be decrypted must not be skipped, the next backup would overwrite it with an empty list. Defined in atrest.go
+		var reencrypt bool
+		if d, reencrypt, err = openData(domain, fileName, d); err != nil {
+			log.Fatalln("Unable to restore backup:", err)
+		}
+		if reencrypt {
+			needsReencryption = true
+		}
 		buf := bytes.NewBuffer(d)
 		dec := gob.NewDecoder(buf)
 		err := dec.Decode(&backupLinkLen)
@@ -55,19 +68,40 @@ func restoreLinkLen(l *LinkLen, typ, domain string) {
 	}
 }
 
+// saveLinkLenBackup saves the backup of the LinkLen l, used when a link is removed before it times out
+func saveLinkLenBackup(l *LinkLen) {
+	lens := domainLinkLens[l.Domain]
+	switch l {
+	case &lens.LinkLen1:
+		saveBackup(l, "len1", l.Domain)
+	case &lens.LinkLen2:
+		saveBackup(l, "len2", l.Domain)
+	case &lens.LinkLen3:
+		saveBackup(l, "len3", l.Domain)
+	case &lens.LinkCustom:
+		saveBackup(l, "custom", l.Domain)
+	}
+}
+
 // part 2 of the fugly solution
 func BackupRoutine() {
 
 	for {
 		time.Sleep(time.Minute * 30)
+		saveAllBackups()
+	}
+}
 
-		for _, domain := range config.DomainNames {
-			saveBackup(&domainLinkLens[domain].LinkLen1, "len1", domain)
-			saveBackup(&domainLinkLens[domain].LinkLen2, "len2", domain)
-			saveBackup(&domainLinkLens[domain].LinkLen3, "len3", domain)
-			saveBackup(&domainLinkLens[domain].LinkCustom, "custom", domain)
-		}
+// saveAllBackups saves the links of all domains to disk, used by BackupRoutine and on shutdown
+func saveAllBackups() {
+	for _, domain := range config.DomainNames {
+		saveBackup(&domainLinkLens[domain].LinkLen1, "len1", domain)
+		saveBackup(&domainLinkLens[domain].LinkLen2, "len2", domain)
+		saveBackup(&domainLinkLens[domain].LinkLen3, "len3", domain)
+		saveBackup(&domainLinkLens[domain].LinkCustom, "custom", domain)
+	}
 
+	if logger != nil {
 		logger.Println("Finished saving new backup")
 	}
 }
@@ -78,43 +112,83 @@ func saveBackup(l *LinkLen, typ, domain string) {
 	filename := "backupdb-" + domain + "-" + typ + ".gob"
 
 	if l == nil {
-		logger.Println("*LinkLen is nil, skipping ", filename)
-		return
-	}
-	if l.NextClear == nil {
-		logger.Println("l.NextClear is nil, skipping ", filename)
+		if logger != nil {
+			logger.Println("*LinkLen is nil, skipping ", filename)
+		}
 		return
 	}
-
+	// the backups of l are written in the same order as the snapshots are taken, e.g. a backup after a burned link must not be
+	// overwritten by a BackupRoutine snapshot from before the link was read
+	l.backupMutex.Lock()
+	defer l.backupMutex.Unlock()
 	l.Mutex.Lock()
-
-	next := *l.NextClear
-
-	stop := false
-	for !stop {
-		backupLinkLen = append(backupLinkLen, next)
-		if next.NextClear != nil {
-			next = *next.NextClear
-		} else {
-			stop = true
-		}
+	// an empty backup is still written so that links that were removed, e.g. after being read, are not restored
+	for next := l.NextClear; next != nil; next = next.NextClear {
+		backupLinkLen = append(backupLinkLen, *next)
 	}
 	l.Mutex.Unlock()
 
 	var backupBuffer bytes.Buffer
 	enc := gob.NewEncoder(&backupBuffer)
 	err = enc.Encode(backupLinkLen)
-	if err != nil {
+	if err != nil && logger != nil {
 		logger.Println(err, "Error while saving backup in enc.Encode()")
 	}
 
 	backupLinkLen = nil
 
-	if err = os.WriteFile(filepath.Join(config.BaseDir, domain, filename), backupBuffer.Bytes(), 0644); err != nil && logger != nil {
-		logger.Println(err, "failed to save DB")
+	// the backup is encrypted if EncryptionKey is set, defined in atrest.go
+	data, err := sealData(domain, filename, backupBuffer.Bytes())
+	if err != nil {
+		if logger != nil {
+			logger.Println(err, "Unable to encrypt backup, skipping", filename)
+		}
+		return
+	}
+	if err = writeFileAtomic(filepath.Join(config.BaseDir, domain, filename), data, 0644); err != nil {
+		if logger != nil {
+			logger.Println(err, "failed to save DB")
+		}
+		return
+	}
+
+	if logger != nil {
+		logger.Println("Backed up:", filename)
 	}
+}
 
-	logger.Println("Backed up:", filename)
+// writeFileAtomic writes data to a temporary file in the directory of path, syncs it and renames it to path, a crash while writing leaves
+// the previous file in place instead of a truncated one that restoreLinkLen can not decrypt
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		// the data must be on disk before the rename, otherwise the renamed file can be empty after a power loss
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// the rename is only durable once the directory is synced
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
 }
 
 // New BoltDB restore
@@ -0,0 +1,152 @@
+// paste.js encrypts texts in the browser before they are uploaded and decrypts them when they are viewed. The key is only kept in the
+// #fragment of the link, which browsers never send to the server, so the server only stores the ciphertext.
+// Format: "v1." + base64url(iv) + "." + base64url(AES-256-GCM ciphertext), the same format is used by shorter paste and shorter read.
+// It also marks the lines selected with #L10 or #L10-L20 in the paste view.
+(function () {
+   "use strict";
+
+   function toBase64URL(bytes) {
+      var s = "";
+      for (var i = 0; i < bytes.length; i++) {
+         s += String.fromCharCode(bytes[i]);
+      }
+      return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+   }
+
+   function fromBase64URL(s) {
+      var b = atob(s.replace(/-/g, "+").replace(/_/g, "/"));
+      var bytes = new Uint8Array(b.length);
+      for (var i = 0; i < b.length; i++) {
+         bytes[i] = b.charCodeAt(i);
+      }
+      return bytes;
+   }
+
+   function encrypt(text) {
+      var key = crypto.getRandomValues(new Uint8Array(32));
+      var iv = crypto.getRandomValues(new Uint8Array(12));
+      return crypto.subtle.importKey("raw", key, "AES-GCM", false, ["encrypt"]).then(function (k) {
+         return crypto.subtle.encrypt({ name: "AES-GCM", iv: iv }, k, new TextEncoder().encode(text));
+      }).then(function (ct) {
+         return { data: "v1." + toBase64URL(iv) + "." + toBase64URL(new Uint8Array(ct)), key: toBase64URL(key) };
+      });
+   }
+
+   function decrypt(data, key) {
+      var parts = data.split(".");
+      if (parts.length !== 3 || parts[0] !== "v1") {
+         return Promise.reject(new Error("unknown format"));
+      }
+      return crypto.subtle.importKey("raw", fromBase64URL(key), "AES-GCM", false, ["decrypt"]).then(function (k) {
+         return crypto.subtle.decrypt({ name: "AES-GCM", iv: fromBase64URL(parts[1]) }, k, fromBase64URL(parts[2]));
+      }).then(function (pt) {
+         return new TextDecoder().decode(pt);
+      });
+   }
+
+   // setupForm encrypts the text of the index form if "encrypt" is checked and shows the link with the key in the fragment
+   function setupForm(form) {
+      form.addEventListener("submit", function (e) {
+         var encryptBox = form.querySelector("input[name=encrypt]");
+         var textRadio = form.querySelector("input[name=requestType][value=text]");
+         if (!encryptBox || !encryptBox.checked || !textRadio || !textRadio.checked) {
+            return;
+         }
+         e.preventDefault();
+         var result = document.getElementById("encryptResult");
+         var body = new FormData(form);
+         encrypt(body.get("text")).then(function (enc) {
+            body.set("requestType", "encrypted");
+            body.set("text", enc.data);
+            body.delete("encrypt");
+            return fetch(form.getAttribute("action") || window.location.pathname, {
+               method: "POST",
+               body: body,
+               headers: { "Accept": "application/json" }
+            }).then(function (resp) {
+               return resp.json().then(function (j) {
+                  if (!resp.ok) {
+                     throw new Error(j.message);
+                  }
+                  var link = document.createElement("a");
+                  link.href = j.url + "#" + enc.key;
+                  link.textContent = link.href;
+                  result.textContent = "";
+                  result.appendChild(link);
+                  result.hidden = false;
+               });
+            });
+         }).catch(function (err) {
+            result.textContent = err.message;
+            result.hidden = false;
+         });
+      });
+   }
+
+   // setupView decrypts the ciphertext of the paste view with the key from the fragment
+   function setupView(el) {
+      var out = document.getElementById("plaintext");
+      var failed = document.getElementById("decryptError");
+      var key = window.location.hash.slice(1);
+      decrypt(el.getAttribute("data-ciphertext"), key).then(function (text) {
+         out.textContent = text;
+         out.hidden = false;
+      }).catch(function () {
+         failed.hidden = false;
+      });
+   }
+
+   // setupLines marks the lines of the #L10-L20 fragment in the paste view, shift click on a line number selects a range
+   function setupLines(table) {
+      var first = 0;
+      function mark() {
+         var m = /^#L(\d+)(?:-L(\d+))?$/.exec(window.location.hash);
+         var rows = table.querySelectorAll("tr.selected");
+         for (var i = 0; i < rows.length; i++) {
+            rows[i].classList.remove("selected");
+         }
+         if (!m) {
+            return;
+         }
+         var from = parseInt(m[1], 10), to = m[2] ? parseInt(m[2], 10) : from;
+         if (to < from) {
+            var t = from; from = to; to = t;
+         }
+         first = from;
+         for (var n = from; n <= to; n++) {
+            var row = document.getElementById("L" + n);
+            if (row) {
+               row.classList.add("selected");
+            }
+         }
+      }
+      table.addEventListener("click", function (e) {
+         if (e.target.tagName !== "A" || !e.shiftKey || !first) {
+            return;
+         }
+         e.preventDefault();
+         window.location.hash = "#L" + first + "-" + e.target.getAttribute("href").slice(1);
+      });
+      window.addEventListener("hashchange", mark);
+      mark();
+      var start = document.getElementById("L" + first);
+      if (start) {
+         start.scrollIntoView();
+      }
+   }
+
+   document.addEventListener("DOMContentLoaded", function () {
+      var form = document.getElementById("shortener");
+      if (form && form.querySelector("input[name=encrypt]")) {
+         setupForm(form);
+      }
+      var table = document.getElementById("paste");
+      if (table) {
+         setupLines(table);
+      }
+      var view = document.getElementById("ciphertext");
+      if (view) {
+         setupView(view);
+      }
+   });
+})();
@@ -3,6 +3,7 @@ package main
 import (
 	"html/template"
 	"log"
+	"time"
 )
 
 const (
@@ -13,16 +14,52 @@ const (
 	// dateFormat specifies the format in which date and time is represented.
 	dateFormat = "Mon 2006-01-02 15:04 MST"
 	// errServerError contains the generic error message users will se when somthing goes wrong
-	errServerError      = "Internal Server Error"
-	errInvalidKey       = "Invalid key"
-	errInvalidKeyUsed   = "Invalid key, key is already in use"
-	errInvalidCustomKey = "Invalid Custom Key was provided, valid characters are:\n" + customKeyCharset
-	errNotImplemented   = "Not Implemented"
-	errLowRAM           = "No Space available, new space will be available as old links become invalid"
+	errServerError        = "Internal Server Error"
+	errInvalidKey         = "Invalid key"
+	errInvalidKeyUsed     = "Invalid key, key is already in use"
+	errInvalidCustomKey   = "Invalid Custom Key was provided, valid characters are:\n" + customKeyCharset
+	errInvalidKeyReserved = "Invalid key, key is reserved"
+	errNotImplemented     = "Not Implemented"
+	errLowRAM             = "No Space available, new space will be available as old links become invalid"
+	errTooManyRequests    = "Too many requests, please try again later"
+	errInvalidRequest     = "Invalid request"
+	errInvalidLength      = "Invalid key length, valid lengths are 1, 2, 3 and custom"
+	errInvalidRequestType = "Invalid request type, valid request types are url, text and encrypted"
+	errInvalidURL         = "Invalid url, only \"http://\" and \"https://\" url schemes are allowed."
+	errInvalidQuickAdd    = "Invalid Quick Add URL request"
+	errKeyNotFound        = "Unknown key, the link does not exist"
+	errLinkExpired        = "This link has expired"
+	errTooLarge           = "The submitted data is too large"
+	errNoKeysLeft         = "No keys left, new keys will be available as old links expire"
+	errInvalidRedirect    = "Invalid redirect mode, valid modes are direct, interstitial and countdown"
+	errInvalidPrefixPath  = "Invalid path, the path after the key can not contain . or .. segments"
+	errPasswordRequired   = "This link is protected by a password"
+	errWrongPassword      = "Wrong password"
+	errPasswordTooLong    = "The password is too long"
+	errServerBusy         = "The server is busy, please try again later"
+	errLinkLocked         = "Too many wrong passwords, the link is locked, please try again later"
+	errLinkBurned         = "This text has already been read and was deleted"
+	errRevealRequired     = "This text is deleted once it is read, send a POST request to reveal it"
+	errInvalidCiphertext  = "Invalid encrypted text"
+	errInvalidLanguage    = "Unknown language"
+	errNotRevisable       = "This text can not be revised"
+	errWrongEditSecret    = "Wrong edit secret"
+	errNotForkable        = "This text can not be forked"
+	errRevisionNotFound   = "This revision does not exist or has been removed"
+	errNotAFork           = "This text is not a fork"
+	errEmptyText          = "The text is empty"
+	errInvalidExpire      = "Invalid expiry, use a duration like 10m or 24h that is not longer than the longest link lifetime"
+	errNetcatTimeout      = "The text was not sent in time"
+	// errLegacyAdminHash is logged on startup while the deprecated Salt and HashSHA256 are still configured
+	errLegacyAdminHash = "Salt and HashSHA256 are deprecated and will be removed, use shorter passwd to create a CredentialsFile"
 	// Do not try to gzip data that is less than minSizeToGzip
 	minSizeToGzip = 128
 	// Max key length for custom links
 	maxKeyLen = 64
+	// maxFormOverhead is the size allowed for the multipart encoding and the other form fields of a POST request in addition to MaxFileSize
+	maxFormOverhead = 64 * 1024
+	// defaultRememberExpired is used if RememberExpiredDuration is not set
+	defaultRememberExpired = 24 * time.Hour
 )
 
 var (
@@ -46,4 +83,11 @@ var (
 	BackupLinkLenC []Link
 
 	templateMap map[string]*template.Template
+
+	// reservedKeys contains custom keys that can not be used since they are handled by other handlers
+	reservedKeys = map[string]bool{
+		"healthz": true,
+		"readyz":  true,
+		"version": true,
+	}
 )
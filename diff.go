@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around each change
+	diffContext = 3
+	// maxDiffEdits limits the work of the diff, texts with more changed lines are shown as completely replaced
+	maxDiffEdits = 2000
+	// maxDiffLines limits the number of lines that are compared after the common prefix and suffix are removed, texts with more lines
+	// left are shown as completely replaced
+	maxDiffLines = 10000
+)
+
+// diffOp is a line of a diff, Kind is ' ' for unchanged lines, '-' for removed lines and '+' for added lines. OldPos and NewPos are the
+// number of lines of the old and new text before the line
+type diffOp struct {
+	Kind           byte
+	Text           string
+	OldPos, NewPos int
+}
+
+// diffLine is a line of the unified diff view, Header is set for the @@ line that starts a hunk
+type diffLine struct {
+	Class      string
+	Header     string
+	OldN, NewN int
+	Text       string
+}
+
+// diffCell is one side of a row in the side by side diff view, N is 0 for empty cells
+type diffCell struct {
+	Class string
+	N     int
+	Text  string
+}
+
+// diffRow is a row of the side by side diff view, Header is set for the row that starts a hunk
+type diffRow struct {
+	Header      string
+	Left, Right diffCell
+}
+
+// diffVars are the template variables of diff.tmpl
+type diffVars struct {
+	Domain string
+	Key    string
+	// From and To describe the compared texts, e.g. "abc revision 1"
+	From, To string
+	// Query is the query of the current view without view, used to switch between the unified and the side by side view
+	Query   string
+	Split   bool
+	Unified []diffLine
+	Rows    []diffRow
+	Changed bool
+	Site    *siteVars
+	L       *localizer
+}
+
+// splitTextLines splits text into lines without the line breaks, an empty text has no lines
+func splitTextLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+}
+
+// diffLines returns the line diff between a and b, the common prefix and suffix are removed before the shortest edit script is searched
+// with the Myers algorithm
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var ops []diffOp
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{Kind: ' ', Text: a[i]})
+	}
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for i := len(a) - suffix; i < len(a); i++ {
+		ops = append(ops, diffOp{Kind: ' ', Text: a[i]})
+	}
+	oldPos, newPos := 0, 0
+	for i := range ops {
+		ops[i].OldPos, ops[i].NewPos = oldPos, newPos
+		if ops[i].Kind != '+' {
+			oldPos++
+		}
+		if ops[i].Kind != '-' {
+			newPos++
+		}
+	}
+	return ops
+}
+
+// myers returns the shortest edit script from a to b, if more than maxDiffEdits edits are needed or more than maxDiffLines lines are compared
+// all of a is removed and all of b is added. The edit script is found with the linear space variant of the algorithm so that a diff only
+// uses memory in proportion to the number of lines
+func myers(a, b []string) []diffOp {
+	if len(a)+len(b) > maxDiffLines || editDistance(a, b, maxDiffEdits) < 0 {
+		ops := make([]diffOp, 0, len(a)+len(b))
+		for _, line := range a {
+			ops = append(ops, diffOp{Kind: '-', Text: line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{Kind: '+', Text: line})
+		}
+		return ops
+	}
+	return diffRange(a, b, make([]diffOp, 0, len(a)+len(b)))
+}
+
+// editDistance returns the number of lines that must be removed or added to turn a into b, or -1 if more than limit edits are needed
+func editDistance(a, b []string, limit int) int {
+	n, m := len(a), len(b)
+	v := make([]int, 2*limit+3)
+	offset := limit + 1
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := furthestX(v, offset, k, d)
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return d
+			}
+		}
+	}
+	return -1
+}
+
+// furthestX returns the x on diagonal k that is reached with d edits from the furthest points of the neighbouring diagonals in v
+func furthestX(v []int, offset, k, d int) int {
+	if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+		return v[offset+k+1]
+	}
+	return v[offset+k-1] + 1
+}
+
+// diffRange appends the shortest edit script from a to b to ops, the texts are split at the middle snake until only additions or removals
+// are left
+func diffRange(a, b []string, ops []diffOp) []diffOp {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		ops = append(ops, diffOp{Kind: ' ', Text: a[0]})
+		a, b = a[1:], b[1:]
+	}
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			ops = append(ops, diffOp{Kind: '+', Text: line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			ops = append(ops, diffOp{Kind: '-', Text: line})
+		}
+	default:
+		// both texts are left and differ at the start and the end, so at least two edits are needed and both halves need fewer
+		x, y := middleSnake(a, b)
+		ops = diffRange(a[:x], b[:y], ops)
+		ops = diffRange(a[x:], b[y:], ops)
+	}
+	for _, line := range common {
+		ops = append(ops, diffOp{Kind: ' ', Text: line})
+	}
+	return ops
+}
+
+// middleSnake searches the shortest edit script from both ends of a and b at the same time and returns the point where the paths meet,
+// the edit script from a[:x] to b[:y] and the one from a[x:] to b[y:] together are a shortest edit script from a to b
+func middleSnake(a, b []string) (x, y int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// forward[k] is the furthest x on diagonal k from the start, backward[k] the furthest distance from the end on diagonal k of the
+	// reversed texts, which is diagonal delta-k of the texts
+	forward := make([]int, 2*maxD+3)
+	backward := make([]int, 2*maxD+3)
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := furthestX(forward, offset, k, d)
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if odd && delta-k >= -(d-1) && delta-k <= d-1 && x+backward[offset+delta-k] >= n {
+				return x, y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			x := furthestX(backward, offset, k, d)
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if !odd && delta-k >= -d && delta-k <= d && x+forward[offset+delta-k] >= n {
+				return n - x, m - y
+			}
+		}
+	}
+	// not reached, the paths meet after at most maxD steps
+	return n, m
+}
+
+// diffHunks groups the changes in ops together with diffContext unchanged lines around them, unchanged lines outside of the hunks are dropped
+func diffHunks(ops []diffOp) [][]diffOp {
+	var hunks [][]diffOp
+	start, end := -1, -1
+	for i, op := range ops {
+		if op.Kind == ' ' {
+			continue
+		}
+		from, to := i-diffContext, i+diffContext+1
+		if from < 0 {
+			from = 0
+		}
+		if to > len(ops) {
+			to = len(ops)
+		}
+		if start >= 0 && from <= end {
+			end = to
+			continue
+		}
+		if start >= 0 {
+			hunks = append(hunks, ops[start:end])
+		}
+		start, end = from, to
+	}
+	if start >= 0 {
+		hunks = append(hunks, ops[start:end])
+	}
+	return hunks
+}
+
+// hunkHeader returns the @@ -l,s +l,s @@ line of a hunk
+func hunkHeader(hunk []diffOp) string {
+	oldLines, newLines := 0, 0
+	for _, op := range hunk {
+		if op.Kind != '+' {
+			oldLines++
+		}
+		if op.Kind != '-' {
+			newLines++
+		}
+	}
+	oldStart, newStart := hunk[0].OldPos, hunk[0].NewPos
+	if oldLines > 0 {
+		oldStart++
+	}
+	if newLines > 0 {
+		newStart++
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", oldStart, oldLines, newStart, newLines)
+}
+
+// unifiedDiff returns the diff in the unified format of diff -u
+func unifiedDiff(from, to string, ops []diffOp) string {
+	var b strings.Builder
+	b.WriteString("--- " + from + "\n+++ " + to + "\n")
+	for _, hunk := range diffHunks(ops) {
+		b.WriteString(hunkHeader(hunk) + "\n")
+		for _, op := range hunk {
+			b.WriteString(string(op.Kind) + op.Text + "\n")
+		}
+	}
+	return b.String()
+}
+
+// diffClass returns the css class of a line of kind
+func diffClass(kind byte) string {
+	switch kind {
+	case '-':
+		return "del"
+	case '+':
+		return "add"
+	}
+	return "ctx"
+}
+
+// unifiedLines returns the lines of the unified diff view
+func unifiedLines(ops []diffOp) []diffLine {
+	var lines []diffLine
+	for _, hunk := range diffHunks(ops) {
+		lines = append(lines, diffLine{Header: hunkHeader(hunk)})
+		for _, op := range hunk {
+			line := diffLine{Class: diffClass(op.Kind), Text: op.Text}
+			if op.Kind != '+' {
+				line.OldN = op.OldPos + 1
+			}
+			if op.Kind != '-' {
+				line.NewN = op.NewPos + 1
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// splitRows returns the rows of the side by side diff view, removed and added lines next to each other are shown in the same rows
+func splitRows(ops []diffOp) []diffRow {
+	var rows []diffRow
+	for _, hunk := range diffHunks(ops) {
+		rows = append(rows, diffRow{Header: hunkHeader(hunk)})
+		for i := 0; i < len(hunk); {
+			if hunk[i].Kind == ' ' {
+				op := hunk[i]
+				rows = append(rows, diffRow{Left: diffCell{Class: "ctx", N: op.OldPos + 1, Text: op.Text}, Right: diffCell{Class: "ctx", N: op.NewPos + 1, Text: op.Text}})
+				i++
+				continue
+			}
+			var removed, added []diffOp
+			for ; i < len(hunk) && hunk[i].Kind == '-'; i++ {
+				removed = append(removed, hunk[i])
+			}
+			for ; i < len(hunk) && hunk[i].Kind == '+'; i++ {
+				added = append(added, hunk[i])
+			}
+			for j := 0; j < len(removed) || j < len(added); j++ {
+				var row diffRow
+				if j < len(removed) {
+					row.Left = diffCell{Class: "del", N: removed[j].OldPos + 1, Text: removed[j].Text}
+				}
+				if j < len(added) {
+					row.Right = diffCell{Class: "add", N: added[j].NewPos + 1, Text: added[j].Text}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
+
+// serveDiff answers r with the diff between two revisions of the text lnk, selected with the query parameters from and to, or with
+// ?parent between the revision of the parent the text was forked from and the text. Browsers get diff.tmpl, all other clients a unified diff
+func serveDiff(w http.ResponseWriter, r *http.Request, lnk *Link, key string) {
+	if !revisable(lnk) {
+		logErrors(w, r, errNotRevisable, http.StatusBadRequest, "")
+		return
+	}
+	// the diff needs memory in proportion to the compared texts
+	if lowRAM() {
+		logErrors(w, r, errLowRAM, http.StatusServiceUnavailable, "")
+		return
+	}
+	q := r.URL.Query()
+	var oldText, newText, from, to string
+	to = key + " revision " + strconv.Itoa(currentRevision(lnk))
+	newRev := currentRevision(lnk)
+	if value := q.Get("to"); value != "" {
+		newRev, _ = strconv.Atoi(value)
+		to = key + " revision " + strconv.Itoa(newRev)
+	}
+	var ok bool
+	if newText, ok = revisionText(lnk, newRev); !ok { // defined in revisions.go
+		logErrors(w, r, errRevisionNotFound, http.StatusNotFound, "")
+		return
+	}
+
+	if _, fork := q["parent"]; fork {
+		if lnk.Parent == "" {
+			logErrors(w, r, errNotAFork, http.StatusBadRequest, "")
+			return
+		}
+		parent, goneMsg := findParent(r.Host, lnk) // defined in revisions.go
+		if goneMsg != "" {
+			logErrors(w, r, goneMsg, http.StatusGone, "")
+			return
+		}
+		if !revisable(&parent) || parent.PasswordHash != "" {
+			logErrors(w, r, errNotForkable, http.StatusBadRequest, "")
+			return
+		}
+		// the revision that was forked is compared if it is still available, otherwise the current revision of the parent
+		parentRev := lnk.ParentRevision
+		if oldText, ok = revisionText(&parent, parentRev); !ok {
+			parentRev = currentRevision(&parent)
+			oldText, _ = revisionText(&parent, parentRev)
+		}
+		from = lnk.Parent + " revision " + strconv.Itoa(parentRev)
+	} else {
+		oldRev := newRev - 1
+		if value := q.Get("from"); value != "" {
+			oldRev, _ = strconv.Atoi(value)
+		}
+		if oldText, ok = revisionText(lnk, oldRev); !ok {
+			logErrors(w, r, errRevisionNotFound, http.StatusNotFound, "")
+			return
+		}
+		from = key + " revision " + strconv.Itoa(oldRev)
+	}
+
+	ops := diffLines(splitTextLines(oldText), splitTextLines(newText))
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		logOK(r, http.StatusOK)
+		fmt.Fprint(w, unifiedDiff(from, to, ops))
+		return
+	}
+
+	t, ok := templateMap[r.Host+"#diff"]
+	if !ok {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to load diff template: "+r.Host+"#diff")
+		return
+	}
+	q.Del("view")
+	vars := diffVars{Domain: requestScheme(r) + "://" + r.Host, Key: key, From: from, To: to, Query: q.Encode(), Split: r.URL.Query().Get("view") == "split",
+		Site: sites[r.Host], L: getLocalizer(r)}
+	for _, op := range ops {
+		if op.Kind != ' ' {
+			vars.Changed = true
+			break
+		}
+	}
+	if vars.Split {
+		vars.Rows = splitRows(ops)
+	} else {
+		vars.Unified = unifiedLines(ops)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, "diff.tmpl", vars); err != nil {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to Execute diff template: "+r.Host+"#diff")
+		return
+	}
+	logOK(r, http.StatusOK)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyOps returns the old and the new text of a diff
+func applyOps(ops []diffOp) (a, b []string) {
+	for _, op := range ops {
+		if op.Kind != '+' {
+			a = append(a, op.Text)
+		}
+		if op.Kind != '-' {
+			b = append(b, op.Text)
+		}
+	}
+	return a, b
+}
+
+// countEdits returns the number of removed and added lines in ops
+func countEdits(ops []diffOp) int {
+	edits := 0
+	for _, op := range ops {
+		if op.Kind != ' ' {
+			edits++
+		}
+	}
+	return edits
+}
+
+// lcsEdits returns the length of the shortest edit script from a to b computed with the longest common subsequence
+func lcsEdits(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] > lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return len(a) + len(b) - 2*lcs[0][0]
+}
+
+// diffKinds returns the kinds of ops as a string, e.g. " -+"
+func diffKinds(ops []diffOp) string {
+	var b strings.Builder
+	for _, op := range ops {
+		b.WriteByte(op.Kind)
+	}
+	return b.String()
+}
+
+// numberedLines returns n lines with the text prefix followed by the line number
+func numberedLines(prefix string, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = prefix + strconv.Itoa(i)
+	}
+	return lines
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []string
+		kinds string
+	}{
+		{"both empty", nil, nil, ""},
+		{"old empty", nil, []string{"a", "b"}, "++"},
+		{"new empty", []string{"a", "b"}, nil, "--"},
+		{"unchanged", []string{"a", "b"}, []string{"a", "b"}, "  "},
+		{"all changed", []string{"a", "b"}, []string{"c", "d"}, "--++"},
+		{"line added", []string{"a", "c"}, []string{"a", "b", "c"}, " + "},
+		{"line removed", []string{"a", "b", "c"}, []string{"a", "c"}, " - "},
+		{"line changed", []string{"a", "b", "c"}, []string{"a", "x", "c"}, " -+ "},
+		{"moved line", []string{"a", "b", "c", "d"}, []string{"b", "c", "d", "a"}, "-   +"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := diffLines(tt.a, tt.b)
+			if got := diffKinds(ops); got != tt.kinds {
+				t.Errorf("diffLines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.kinds)
+			}
+		})
+	}
+}
+
+func TestDiffLinesShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"a", "b", "c", "d"}
+	for i := 0; i < 500; i++ {
+		a := make([]string, rng.Intn(12))
+		for j := range a {
+			a[j] = words[rng.Intn(len(words))]
+		}
+		b := make([]string, rng.Intn(12))
+		for j := range b {
+			b[j] = words[rng.Intn(len(words))]
+		}
+		ops := diffLines(a, b)
+		gotA, gotB := applyOps(ops)
+		if strings.Join(gotA, "\n") != strings.Join(a, "\n") || strings.Join(gotB, "\n") != strings.Join(b, "\n") {
+			t.Fatalf("diffLines(%q, %q) does not contain the texts: %q", a, b, diffKinds(ops))
+		}
+		if got, want := countEdits(ops), lcsEdits(a, b); got != want {
+			t.Fatalf("diffLines(%q, %q) has %d edits, want %d", a, b, got, want)
+		}
+	}
+}
+
+func TestDiffLinesOverCap(t *testing.T) {
+	// more changed lines than maxDiffEdits are shown as completely replaced, only the common first line is kept
+	a, b := numberedLines("a", maxDiffEdits), numberedLines("b", maxDiffEdits)
+	for i := 0; i < len(a); i += 3 {
+		b[i] = a[i]
+	}
+	ops := diffLines(a, b)
+	if got := countEdits(ops); got != 2*(len(a)-1) {
+		t.Errorf("got %d edits over the edit cap, want %d", got, 2*(len(a)-1))
+	}
+
+	// more lines than maxDiffLines are not compared
+	a, b = numberedLines("a", maxDiffLines), numberedLines("a", maxDiffLines)
+	b[1] = "changed"
+	b[len(b)-2] = "changed"
+	start := time.Now()
+	ops = diffLines(a, b)
+	if got := countEdits(ops); got != 2*(len(a)-2) {
+		t.Errorf("got %d edits over the line cap, want %d", got, 2*(len(a)-2))
+	}
+	if gotA, gotB := applyOps(ops); len(gotA) != len(a) || len(gotB) != len(b) {
+		t.Errorf("the diff over the line cap does not contain the texts")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the diff over the line cap took %v", time.Since(start))
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	lines := numberedLines("l", 20)
+	changed := append([]string{}, lines...)
+	changed[1] = "x"
+	changed[18] = "y"
+	tests := []struct {
+		name    string
+		a, b    []string
+		headers []string
+	}{
+		{"empty", nil, nil, nil},
+		{"unchanged", lines, lines, nil},
+		{"added to empty", nil, []string{"a", "b"}, []string{"@@ -0,0 +1,2 @@"}},
+		{"all removed", []string{"a", "b"}, nil, []string{"@@ -1,2 +0,0 @@"}},
+		{"all changed", []string{"a", "b"}, []string{"c"}, []string{"@@ -1,2 +1,1 @@"}},
+		{"separate hunks", lines, changed, []string{"@@ -1,5 +1,5 @@", "@@ -16,5 +16,5 @@"}},
+		{"merged hunks", lines[:8], append(append([]string{}, changed[:7]...), "z"), []string{"@@ -1,8 +1,8 @@"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hunks := diffHunks(diffLines(tt.a, tt.b))
+			if len(hunks) != len(tt.headers) {
+				t.Fatalf("got %d hunks, want %d", len(hunks), len(tt.headers))
+			}
+			for i, hunk := range hunks {
+				if got := hunkHeader(hunk); got != tt.headers[i] {
+					t.Errorf("hunk %d has the header %s, want %s", i, got, tt.headers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	got := unifiedDiff("a revision 1", "a revision 2", diffLines([]string{"a", "b"}, []string{"a", "c"}))
+	want := "--- a revision 1\n+++ a revision 2\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n"
+	if got != want {
+		t.Errorf("unifiedDiff() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedPrefix is the version prefix of the ciphertext format shared by paste.js, shorter paste and shorter read
+	encryptedPrefix = "v1"
+	// encryptedKeyLen and encryptedIVLen are the AES-256-GCM key and nonce sizes
+	encryptedKeyLen = 32
+	encryptedIVLen  = 12
+)
+
+// encryptedVars are the template variables of encrypted.tmpl
+type encryptedVars struct {
+	Domain string
+	// Data is the ciphertext, it is decrypted by paste.js with the key from the #fragment
+	Data string
+	Site *siteVars
+	L    *localizer
+}
+
+// validCiphertext returns true if data has the format "v1." + base64url(iv) + "." + base64url(ciphertext), the content can not be checked
+func validCiphertext(data string) bool {
+	parts := strings.Split(data, ".")
+	if len(parts) != 3 || parts[0] != encryptedPrefix {
+		return false
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(iv) != encryptedIVLen {
+		return false
+	}
+	ct, err := base64.RawURLEncoding.DecodeString(parts[2])
+	// the ciphertext contains at least the GCM tag
+	return err == nil && len(ct) >= 16
+}
+
+// encryptPaste encrypts plaintext with a new random key and returns the ciphertext and the base64url encoded key
+func encryptPaste(plaintext []byte) (data, key string, err error) {
+	k := make([]byte, encryptedKeyLen)
+	iv := make([]byte, encryptedIVLen)
+	if _, err := rand.Read(k); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return "", "", err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return "", "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", "", err
+	}
+	ct := gcm.Seal(nil, iv, plaintext, nil)
+	data = encryptedPrefix + "." + base64.RawURLEncoding.EncodeToString(iv) + "." + base64.RawURLEncoding.EncodeToString(ct)
+	return data, base64.RawURLEncoding.EncodeToString(k), nil
+}
+
+// decryptPaste decrypts data created by encryptPaste or paste.js with the base64url encoded key
+func decryptPaste(data, key string) ([]byte, error) {
+	if !validCiphertext(data) {
+		return nil, errors.New("the text is not an encrypted paste")
+	}
+	parts := strings.Split(data, ".")
+	k, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(k) != encryptedKeyLen {
+		return nil, errors.New("invalid key, the key is the part of the link after #")
+	}
+	iv, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	ct, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, ct, nil)
+	if err != nil {
+		return nil, errors.New("unable to decrypt the text, the key does not match")
+	}
+	return plaintext, nil
+}
+
+// serveEncrypted answers a request for an encrypted paste, browsers get encrypted.tmpl which decrypts the paste with paste.js and all other
+// clients, e.g. shorter read, get the ciphertext as plain text
+func serveEncrypted(w http.ResponseWriter, r *http.Request, lnk *Link) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		logOK(r, http.StatusOK)
+		fmt.Fprint(w, lnk.Data)
+		return
+	}
+	t, ok := templateMap[r.Host+"#encrypted"]
+	if !ok {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to load encrypted template: "+r.Host+"#encrypted")
+		return
+	}
+	vars := encryptedVars{Domain: requestScheme(r) + "://" + r.Host, Data: lnk.Data, Site: sites[r.Host], L: getLocalizer(r)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the key is in the fragment, the referrer would not contain it but there is no reason to leak the link either
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := t.ExecuteTemplate(w, "encrypted.tmpl", vars); err != nil {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to Execute encrypted template: "+r.Host+"#encrypted")
+		return
+	}
+	logOK(r, http.StatusOK)
+}
+
+// pasteCommand implements shorter paste, it encrypts stdin and uploads the ciphertext to a shorter server. The printed link contains the key
+// in the #fragment, the server never sees the key
+func pasteCommand(args []string) int {
+	flags := flag.NewFlagSet("paste", flag.ContinueOnError)
+	length := flags.String("len", "3", "key length, 1, 2, 3 or custom")
+	custom := flags.String("custom", "", "custom key, requires -len custom")
+	burn := flags.Bool("burn", false, "delete the paste after it has been read once")
+	password := flags.String("password", "", "optional password that is required to read the paste")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: shorter paste [-len 1|2|3|custom] [-custom key] [-burn] [-password password] https://example.com < file")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	server := strings.TrimSuffix(flags.Arg(0), "/")
+
+	plaintext, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data, key, err := encryptPaste(plaintext)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := map[string]string{"len": *length, "custom": *custom, "requestType": "encrypted", "text": data, "password": *password}
+	if *burn {
+		fields["burn"] = "on"
+	}
+	for name, value := range fields {
+		if value != "" {
+			form.WriteField(name, value)
+		}
+	}
+	form.Close()
+	req, err := http.NewRequest(http.MethodPost, server+"/", &body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	var created createdResponse // defined in handlers.go
+	if err := decodeJSONResponse(resp, &created); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(created.URL + "#" + key)
+	return 0
+}
+
+// decodeJSONResponse decodes the createdResponse or errorResponse in resp, an errorResponse is returned as an error
+func decodeJSONResponse(resp *http.Response, v interface{}) error {
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse // defined in errors.go
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return errors.New(resp.Status + ": " + e.Message)
+		}
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, v)
+}
+
+// readCommand implements shorter read, it downloads an encrypted paste and decrypts it with the key from the #fragment of the link
+func readCommand(args []string) int {
+	flags := flag.NewFlagSet("read", flag.ContinueOnError)
+	password := flags.String("password", "", "password of a password protected paste")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: shorter read [-password password] 'https://example.com/key#secret'")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || !strings.Contains(flags.Arg(0), "#") {
+		flags.Usage()
+		return 2
+	}
+	link := flags.Arg(0)
+	i := strings.Index(link, "#")
+	link, key := link[:i], link[i+1:]
+
+	// burn after reading pastes are revealed with a POST request, it is used for all pastes so that a single request is enough
+	// the password is sent in the form since POST requests are unlocked with the form field password, see unlockLink in unlock.go
+	form := url.Values{}
+	if *password != "" {
+		form.Set("password", *password)
+	}
+	req, err := http.NewRequest(http.MethodPost, link, strings.NewReader(form.Encode()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<30))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, resp.Status+":", strings.TrimSpace(string(data)))
+		return 1
+	}
+	plaintext, err := decryptPaste(strings.TrimSpace(string(data)), key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(plaintext)
+	return 0
+}
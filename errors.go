@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var (
+	// errorStatus maps the user facing error messages to the HTTP status code they are answered with, messages that are not listed are answered with 500
+	errorStatus = map[string]int{
+		errInvalidRequest:     http.StatusBadRequest,
+		errInvalidKey:         http.StatusBadRequest,
+		errInvalidCustomKey:   http.StatusBadRequest,
+		errInvalidKeyReserved: http.StatusBadRequest,
+		errInvalidLength:      http.StatusBadRequest,
+		errInvalidRequestType: http.StatusBadRequest,
+		errInvalidURL:         http.StatusBadRequest,
+		errInvalidQuickAdd:    http.StatusBadRequest,
+		errInvalidRedirect:    http.StatusBadRequest,
+		errInvalidPrefixPath:  http.StatusBadRequest,
+		errPasswordTooLong:    http.StatusBadRequest,
+		errInvalidCiphertext:  http.StatusBadRequest,
+		errInvalidLanguage:    http.StatusBadRequest,
+		errNotRevisable:       http.StatusBadRequest,
+		errNotForkable:        http.StatusBadRequest,
+		errWrongEditSecret:    http.StatusForbidden,
+		errRevisionNotFound:   http.StatusNotFound,
+		errNotAFork:           http.StatusBadRequest,
+		errEmptyText:          http.StatusBadRequest,
+		errInvalidExpire:      http.StatusBadRequest,
+		errNetcatTimeout:      http.StatusRequestTimeout,
+		errPasswordRequired:   http.StatusUnauthorized,
+		errWrongPassword:      http.StatusForbidden,
+		errLinkLocked:         http.StatusTooManyRequests,
+		errLinkBurned:         http.StatusGone,
+		errRevealRequired:     http.StatusPreconditionRequired,
+		errKeyNotFound:        http.StatusNotFound,
+		errInvalidKeyUsed:     http.StatusConflict,
+		errLinkExpired:        http.StatusGone,
+		errTooLarge:           http.StatusRequestEntityTooLarge,
+		errTooManyRequests:    http.StatusTooManyRequests,
+		errNotImplemented:     http.StatusNotImplemented,
+		errLowRAM:             http.StatusServiceUnavailable,
+		errServerBusy:         http.StatusServiceUnavailable,
+		errNoKeysLeft:         http.StatusServiceUnavailable,
+	}
+	// errorCodes contains the machine readable error codes returned to API clients for each status code
+	errorCodes = map[int]string{
+		http.StatusBadRequest:            "invalid_input",
+		http.StatusUnauthorized:          "password_required",
+		http.StatusForbidden:             "wrong_password",
+		http.StatusNotFound:              "not_found",
+		http.StatusConflict:              "key_taken",
+		http.StatusGone:                  "gone",
+		http.StatusRequestEntityTooLarge: "too_large",
+		http.StatusPreconditionRequired:  "reveal_required",
+		http.StatusTooManyRequests:       "too_many_requests",
+		http.StatusInternalServerError:   "server_error",
+		http.StatusNotImplemented:        "not_implemented",
+		http.StatusServiceUnavailable:    "unavailable",
+	}
+)
+
+// errorVars are the template variables of error.tmpl
+type errorVars struct {
+	Domain string
+	// Status is the HTTP status code and StatusText the English name of the status, e.g. 404 and "Not Found"
+	Status     int
+	StatusText string
+	// Message is the user facing error message, it is translated in the template with .L.T
+	Message string
+	Site    *siteVars
+	L       *localizer
+}
+
+// errorResponse is the body of error responses to API clients
+type errorResponse struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// statusFor returns the HTTP status code for the user facing error message msg
+func statusFor(msg string) int {
+	if status, ok := errorStatus[msg]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError answers r with msg and statusCode. API clients that accept application/json get an errorResponse, browsers get the error.tmpl
+// of the requested domain and all other clients, e.g. curl, get the message as plain text. msg is translated into the language negotiated for r
+func writeError(w http.ResponseWriter, r *http.Request, msg string, statusCode int) {
+	l := getLocalizer(r) // defined in i18n.go
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") {
+		code, ok := errorCodes[statusCode]
+		if !ok {
+			code = errorCodes[http.StatusInternalServerError]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(errorResponse{Status: statusCode, Error: code, Message: l.T(msg)})
+		return
+	}
+	if strings.Contains(accept, "text/html") {
+		if t, ok := templateMap[r.Host+"#error"]; ok {
+			// render to a buffer first so that a failing template can still be answered with a plain text error
+			var buf bytes.Buffer
+			vars := errorVars{Domain: requestScheme(r) + "://" + r.Host, Status: statusCode, StatusText: http.StatusText(statusCode), Message: msg, Site: sites[r.Host], L: l}
+			if err := t.ExecuteTemplate(&buf, "error.tmpl", vars); err == nil {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(statusCode)
+				buf.WriteTo(w)
+				return
+			} else if logger != nil {
+				logger.Println("ERROR executing template error.tmpl for host:", r.Host, "with the error:", err)
+			}
+		}
+	}
+	http.Error(w, l.T(msg), statusCode)
+}
+
+// addFailed answers a request where LinkLen.Add returned err, the errors returned by Add are user facing messages
+func addFailed(w http.ResponseWriter, r *http.Request, err error) {
+	logErrors(w, r, err.Error(), statusFor(err.Error()), "Unable to add link")
+}
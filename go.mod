@@ -3,14 +3,10 @@ module github.com/7i/shorter
 go 1.17
 
 require (
-	github.com/kr/pretty v0.3.1
 	golang.org/x/crypto v0.4.0
+	golang.org/x/net v0.4.0
+	golang.org/x/text v0.5.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require (
-	github.com/kr/text v0.2.0 // indirect
-	github.com/rogpeppe/go-internal v1.9.0 // indirect
-	golang.org/x/net v0.4.0 // indirect
-	golang.org/x/text v0.5.0 // indirect
-)
+require golang.org/x/sys v0.3.0 // indirect
@@ -3,13 +3,12 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"html"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -21,7 +20,7 @@ func handleRoot(mux *http.ServeMux) {
 		if validRequest(r) {
 			handleRequests(w, r)
 		} else {
-			http.Error(w, errServerError, http.StatusInternalServerError)
+			logErrors(w, r, errInvalidRequest, http.StatusBadRequest, "Error: invalid host or method.")
 		}
 	}
 	mux.HandleFunc("/", handler)
@@ -36,7 +35,7 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 
 	// browsers should send a path that begins with a /
 	if r.URL.Path[0] != '/' {
-		logErrors(w, r, errServerError, http.StatusInternalServerError, "")
+		logErrors(w, r, errInvalidRequest, http.StatusBadRequest, "")
 		return
 	}
 
@@ -44,17 +43,43 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 		handleGET(w, r)
 		return
 	}
-
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+	// POST requests for a key submit the unlock form of a password protected link, defined in unlock.go
+	if r.Method == http.MethodPost && r.URL.Path != "/" {
+		limit := int64(maxFormOverhead)
+		// new revisions of a text are as large as new texts, defined in revisions.go
+		if strings.HasSuffix(r.URL.Path, "/revise") {
+			limit += config.MaxFileSize
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		handleGET(w, r)
+		return
 	}
 
+	scheme := requestScheme(r)
+
 	// If the user tries to submit data via POST
 	if r.Method == http.MethodPost {
+		if !allowRequest(w, r, getRateLimiters(r).Create, "Create") {
+			return
+		}
+		if r.ContentLength > config.MaxFileSize+maxFormOverhead {
+			logErrors(w, r, errTooLarge, http.StatusRequestEntityTooLarge, "")
+			return
+		}
+		// the Content-Length is not required, e.g. for chunked uploads, so the body is limited as well
+		r.Body = http.MaxBytesReader(w, r.Body, config.MaxFileSize+maxFormOverhead)
+		// the raw body or a single form field from a terminal, e.g. curl --data-binary @file, defined in upload.go
+		if plainUpload(w, r) {
+			return
+		}
+		// url encoded API calls have already been parsed by plainUpload and are not multipart
 		err := r.ParseMultipartForm(config.MaxFileSize)
-		if err != nil {
-			logErrors(w, r, errServerError, http.StatusInternalServerError, "Error: "+url.QueryEscape(err.Error()))
+		if err != nil && err != http.ErrNotMultipart {
+			if strings.Contains(err.Error(), "request body too large") {
+				logErrors(w, r, errTooLarge, http.StatusRequestEntityTooLarge, "")
+				return
+			}
+			logErrors(w, r, errInvalidRequest, http.StatusBadRequest, "Error: "+url.QueryEscape(err.Error()))
 			return
 		}
 
@@ -71,7 +96,7 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 		case "custom":
 			currentLinkLen = &domainLinkLens[r.Host].LinkCustom
 		default:
-			logErrors(w, r, errServerError, http.StatusInternalServerError, "Error: Invalid len argument.")
+			logErrors(w, r, errInvalidLength, http.StatusBadRequest, "Error: Invalid len argument.")
 			return
 		}
 
@@ -79,7 +104,7 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 		xTimes, err := strconv.Atoi(r.Form.Get("xTimes"))
 		if err != nil || xTimes < 1 {
 			xTimes = -1
-		} else if xTimes > config.LinkAccessMaxNr {
+		} else if config.LinkAccessMaxNr > 0 && xTimes > config.LinkAccessMaxNr {
 			xTimes = config.LinkAccessMaxNr
 		}
 
@@ -87,13 +112,20 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 		customKey := ""
 		if length == "custom" {
 			customKey = r.Form.Get("custom")
+			if reservedKeys[customKey] {
+				logErrors(w, r, errInvalidKeyReserved, http.StatusBadRequest, "")
+				return
+			}
 			if !validate(customKey) || len(customKey) < 4 || len(customKey) > maxKeyLen {
-				logErrors(w, r, errInvalidCustomKey, http.StatusInternalServerError, "")
+				logErrors(w, r, errInvalidCustomKey, http.StatusBadRequest, "")
 				return
 			}
 
-			if _, used := domainLinkLens[r.Host].LinkCustom.LinkMap[customKey]; used {
-				http.Error(w, errInvalidKeyUsed, http.StatusInternalServerError)
+			domainLinkLens[r.Host].LinkCustom.Mutex.RLock()
+			_, used := domainLinkLens[r.Host].LinkCustom.LinkMap[customKey]
+			domainLinkLens[r.Host].LinkCustom.Mutex.RUnlock()
+			if used {
+				logErrors(w, r, errInvalidKeyUsed, http.StatusConflict, "")
 				return
 			}
 		}
@@ -105,7 +137,21 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 			formURL := r.Form.Get("url")
 			valid := validURL(formURL)
 			if !valid {
-				logErrors(w, r, "Invalid url, only \"http://\" and \"https://\" url schemes are allowed.", http.StatusInternalServerError, "")
+				logErrors(w, r, errInvalidURL, http.StatusBadRequest, "")
+				return
+			}
+			// prefix links forward the path and query after the key to the url, e.g. a checkbox sends "on"
+			prefix := r.Form.Get("prefix")
+			isPrefix := prefix == "on" || prefix == "true" || prefix == "1"
+			redirect := r.Form.Get("redirect")
+			if redirect != "" && !validRedirectModes[redirect] {
+				logErrors(w, r, errInvalidRedirect, http.StatusBadRequest, "")
+				return
+			}
+			// the optional password is hashed once the request is valid, defined in unlock.go
+			passwordHash, errMsg := linkPasswordHash(r)
+			if errMsg != "" {
+				logErrors(w, r, errMsg, statusFor(errMsg), "")
 				return
 			}
 			currentLinkLen.Mutex.RLock()
@@ -114,35 +160,46 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 
 			isCompressed := false
 
-			showLnk := &Link{Key: customKey, LinkType: "url", Data: formURL, IsCompressed: isCompressed, Times: xTimes, Timeout: time.Now().Add(currentLinkLenTimeout)}
+			showLnk := &Link{Key: customKey, LinkType: "url", Data: formURL, IsCompressed: isCompressed, Times: xTimes, Redirect: redirect, Prefix: isPrefix, PasswordHash: passwordHash, Timeout: time.Now().Add(currentLinkLenTimeout)}
 			key, err := currentLinkLen.Add(showLnk)
 			if err == nil {
+				if writeCreated(w, r, createdResponse{URL: scheme + "://" + r.Host + "/" + key, Expires: showLnk.Timeout}) {
+					return
+				}
 				w.Header().Add("Content-Type", "text/html; charset=utf-8")
-				logger.Println("requesting template :", r.Host+"showLink")
 				t, ok := templateMap[r.Host+"#showLink"]
 				if !ok {
-					logger.Println("ERROR getting template template :", r.Host+"showLink")
-					http.Error(w, errServerError, http.StatusInternalServerError)
+					if logger != nil {
+						logger.Println("ERROR getting template template :", r.Host+"showLink")
+					}
+					http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 					return
 				}
 
-				tmplArgs := showLinkVars{Domain: scheme + "://" + r.Host, Data: scheme + "://" + r.Host + "/" + key, Timeout: showLnk.Timeout.Format("Mon 2006-01-02 15:04 MST")}
+				tmplArgs := newShowLinkVars(r, scheme, scheme+"://"+r.Host+"/"+key, showLnk.Timeout) // defined in themes.go
 
 				err = t.ExecuteTemplate(w, "showLink.tmpl", tmplArgs)
 				if err != nil {
-					logger.Println("ERROR executing template template showLink.tmpl for host :", r.Host, "with args: ", tmplArgs, "with the error: ", err)
-					http.Error(w, errServerError, http.StatusInternalServerError)
+					if logger != nil {
+						logger.Println("ERROR executing template template showLink.tmpl for host :", r.Host, "with args: ", tmplArgs, "with the error: ", err)
+					}
+					http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 				}
 				logOK(r, http.StatusOK)
 				return
 			}
+			addFailed(w, r, err) // defined in errors.go
 			return
 		case "text":
 			if lowRAM() {
-				logErrors(w, r, errServerError, http.StatusInternalServerError, errLowRAM)
+				logErrors(w, r, errLowRAM, http.StatusServiceUnavailable, "")
 				return
 			}
 			textBlob := r.Form.Get("text")
+			if int64(len(textBlob)) > config.MaxFileSize {
+				logErrors(w, r, errTooLarge, http.StatusRequestEntityTooLarge, "")
+				return
+			}
 
 			isCompressed := false
 			if len(textBlob) > minSizeToGzip {
@@ -157,28 +214,121 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 			currentLinkLenTimeout := currentLinkLen.Timeout
 			currentLinkLen.Mutex.RUnlock()
 
-			showLnk := &Link{Key: customKey, LinkType: "text", Data: textBlob, IsCompressed: isCompressed, Times: xTimes, Timeout: time.Now().Add(currentLinkLenTimeout)}
+			// burn after reading is only available for texts, e.g. a checkbox sends "on"
+			burn := r.Form.Get("burn")
+			isBurn := burn == "on" || burn == "true" || burn == "1"
+
+			// the language of the paste view, detected from the text when the link is viewed if it is not set. Defined in highlight.go
+			lang := r.Form.Get("lang")
+			if lang != "" && languages[lang] == nil {
+				logErrors(w, r, errInvalidLanguage, http.StatusBadRequest, "")
+				return
+			}
+
+			// a fork references the text it was copied from so that the fork can be diffed against it, defined in revisions.go
+			var parent Link
+			if fork := r.Form.Get("fork"); fork != "" {
+				var ok bool
+				if parent, ok = lookupFork(w, r, fork); !ok {
+					return
+				}
+			}
+
+			// the optional password is hashed once the request is valid, defined in unlock.go
+			passwordHash, errMsg := linkPasswordHash(r)
+			if errMsg != "" {
+				logErrors(w, r, errMsg, statusFor(errMsg), "")
+				return
+			}
+
+			// the edit secret is required to add revisions, burn after reading texts can not be revised
+			editSecret, editHash := "", ""
+			if !isBurn && maxRevisions() > 0 {
+				var err error
+				if editSecret, editHash, err = newEditSecret(); err != nil {
+					logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to create edit secret: "+url.QueryEscape(err.Error()))
+					return
+				}
+			}
+
+			now := time.Now()
+			showLnk := &Link{Key: customKey, LinkType: "text", Data: textBlob, IsCompressed: isCompressed, Times: xTimes, BurnAfterReading: isBurn, Language: lang, EditHash: editHash, Updated: now, Created: now, Parent: parent.Key, PasswordHash: passwordHash, Timeout: now.Add(currentLinkLenTimeout)}
+			if parent.Key != "" {
+				showLnk.ParentRevision = currentRevision(&parent)
+				showLnk.ParentCreated = createdAt(&parent)
+			}
 			key, err := currentLinkLen.Add(showLnk)
 			if err == nil {
+				if writeCreated(w, r, createdResponse{URL: scheme + "://" + r.Host + "/" + key, Expires: showLnk.Timeout, EditSecret: editSecret}) {
+					return
+				}
 				w.Header().Add("Content-Type", "text/html; charset=utf-8")
 				t, ok := templateMap[r.Host+"#showLink"]
 				if !ok {
-					http.Error(w, errServerError, http.StatusInternalServerError)
+					http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 					return
 				}
-				tmplArgs := showLinkVars{Domain: scheme + "://" + r.Host, Data: scheme + "://" + r.Host + "/" + key, Timeout: showLnk.Timeout.Format("Mon 2006-01-02 15:04 MST")}
+				tmplArgs := newShowLinkVars(r, scheme, scheme+"://"+r.Host+"/"+key, showLnk.Timeout) // defined in themes.go
+				tmplArgs.EditSecret = editSecret
 
 				err = t.ExecuteTemplate(w, "showLink.tmpl", tmplArgs)
 				if err != nil {
-					logger.Println("ERROR executing template template showLink.tmpl for host :", r.Host, "with args: ", tmplArgs)
-					http.Error(w, errServerError, http.StatusInternalServerError)
+					if logger != nil {
+						logger.Println("ERROR executing template template showLink.tmpl for host :", r.Host, "with the error:", err)
+					}
+					http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 				}
 				logOK(r, http.StatusOK)
 				return
 			}
+			addFailed(w, r, err) // defined in errors.go
+			return
+		case "encrypted":
+			// the text was encrypted by the client, the server only checks the format since it never sees the key. Defined in encrypted.go
+			ciphertext := r.Form.Get("text")
+			if int64(len(ciphertext)) > config.MaxFileSize {
+				logErrors(w, r, errTooLarge, http.StatusRequestEntityTooLarge, "")
+				return
+			}
+			if !validCiphertext(ciphertext) {
+				logErrors(w, r, errInvalidCiphertext, http.StatusBadRequest, "")
+				return
+			}
+			if lowRAM() {
+				logErrors(w, r, errLowRAM, http.StatusServiceUnavailable, "")
+				return
+			}
+
+			currentLinkLen.Mutex.RLock()
+			currentLinkLenTimeout := currentLinkLen.Timeout
+			currentLinkLen.Mutex.RUnlock()
+
+			burn := r.Form.Get("burn")
+			isBurn := burn == "on" || burn == "true" || burn == "1"
+			// the optional password is hashed once the request is valid, defined in unlock.go
+			passwordHash, errMsg := linkPasswordHash(r)
+			if errMsg != "" {
+				logErrors(w, r, errMsg, statusFor(errMsg), "")
+				return
+			}
+
+			// ciphertext does not compress so it is always stored as is
+			showLnk := &Link{Key: customKey, LinkType: "encrypted", Data: ciphertext, Times: xTimes, BurnAfterReading: isBurn, PasswordHash: passwordHash, Timeout: time.Now().Add(currentLinkLenTimeout)}
+			key, err := currentLinkLen.Add(showLnk)
+			if err == nil {
+				if writeCreated(w, r, createdResponse{URL: scheme + "://" + r.Host + "/" + key, Expires: showLnk.Timeout}) {
+					return
+				}
+				// the link is shown without the key, clients that want the full link ask for JSON and append #key themselves
+				w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+				logOK(r, http.StatusOK)
+				fmt.Fprintln(w, scheme+"://"+r.Host+"/"+key)
+				return
+			}
+			addFailed(w, r, err) // defined in errors.go
 			return
 		default:
-			logErrors(w, r, errNotImplemented, http.StatusNotImplemented, "Error: Invalid requestType argument.")
+			logErrors(w, r, errInvalidRequestType, http.StatusBadRequest, "Error: Invalid requestType argument.")
 			return
 		}
 	}
@@ -188,11 +338,12 @@ func handleRequests(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, scheme+"://"+r.Host, http.StatusSeeOther)
 }
 
-// handleGET will handle GET requests and redirect to the saved link for a key, return a saved textblob or return a file
+// handleGET will handle GET requests and redirect to the saved link for a key, return a saved textblob or return a file.
+// POST requests for a key are handled the same way after the password in the form has unlocked the link
 func handleGET(w http.ResponseWriter, r *http.Request) {
 
 	if !validRequest(r) {
-		logErrors(w, r, errServerError, http.StatusInternalServerError, "Error: invalid request.")
+		logErrors(w, r, errInvalidRequest, http.StatusBadRequest, "Error: invalid request.")
 		return
 	}
 
@@ -210,7 +361,17 @@ func handleGET(w http.ResponseWriter, r *http.Request) {
 			logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to load index template: "+r.Host+"#index")
 			return
 		}
-		err := indexTmpl.Execute(w, nil)
+		vars := indexVars{Domain: requestScheme(r) + "://" + r.Host, Languages: languageOptions(), Site: sites[r.Host], L: getLocalizer(r)}
+		// /?fork=key fills the form with the text that is forked, defined in revisions.go
+		if fork := r.URL.Query().Get("fork"); fork != "" {
+			parent, ok := lookupFork(w, r, fork)
+			if !ok {
+				return
+			}
+			vars.Fork = parent.Key
+			vars.ForkText, _ = revisionText(&parent, currentRevision(&parent))
+		}
+		err := indexTmpl.Execute(w, vars)
 		if err != nil {
 			logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to Execute index template: "+r.Host+"#index")
 			return
@@ -221,23 +382,59 @@ func handleGET(w http.ResponseWriter, r *http.Request) {
 
 	// verify that key only consists of valid characters
 	if !validate(key) {
-		logErrors(w, r, errInvalidKey, http.StatusInternalServerError, "")
+		logErrors(w, r, errInvalidKey, http.StatusBadRequest, "")
+		return
+	}
+
+	limiters := getRateLimiters(r)
+
+	// the limits apply before the quick add check as well, it looks up the key and answers differently if it exists
+	if !allowRequest(w, r, limiters.Lookup, "Lookup") {
+		return
+	}
+	// clients that have used up their failed lookup budget are blocked from all lookups until the budget is refilled
+	if blocked, retryAfter := limiters.FailedLookup.Blocked(rateLimitKey(r)); blocked {
+		tooManyRequests(w, r, retryAfter, "FailedLookup")
 		return
 	}
 
 	// quick check if request is quickAddURL request
 	if len(r.URL.RawQuery) > 0 {
 		if key == "listactive~" {
+			if !allowRequest(w, r, limiters.AdminLogin, "AdminLogin") {
+				return
+			}
 			listActiveLinks(w, r)
 			return
 		}
-		if validURL(r.URL.RawQuery) {
-			quickAddURL(w, r, r.URL.RawQuery, key)
-			return
-		} else {
-			logErrors(w, r, "Invalid Quick Add URL request", http.StatusInternalServerError, "Invalid Quick Add URL request, please use the following syntax: \""+r.Host+"?http://example.com/\". where http://example.com/ is your link.\nAlso note that only \"http://\" and \"https://\" url schemes are allowed.")
+		if key == "certstatus~" {
+			if !allowRequest(w, r, limiters.AdminLogin, "AdminLogin") {
+				return
+			}
+			listCertStatus(w, r) // defined in letsencrypt.go
 			return
 		}
+		// the query of a request for a prefix link is forwarded to the target and the query of a text link selects the language of the
+		// paste view, neither is used for a quick add
+		_, lnk, _ := findLink(r.Host, key)
+		if lnk == nil {
+			if ok, retryAfter := limiters.FailedLookup.Allow(rateLimitKey(r)); !ok {
+				tooManyRequests(w, r, retryAfter, "FailedLookup")
+				return
+			}
+		}
+		if lnk == nil || !lnk.Prefix && lnk.LinkType != "text" {
+			if validURL(r.URL.RawQuery) {
+				if !allowRequest(w, r, limiters.Create, "Create") {
+					return
+				}
+				quickAddURL(w, r, r.URL.RawQuery, key)
+				return
+			} else {
+				logErrors(w, r, errInvalidQuickAdd, http.StatusBadRequest, "Invalid Quick Add URL request, please use the following syntax: \""+r.Host+"?http://example.com/\". where http://example.com/ is your link.\nAlso note that only \"http://\" and \"https://\" url schemes are allowed.")
+				return
+			}
+		}
 	}
 
 	var showLink bool
@@ -253,84 +450,133 @@ func handleGET(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
-	}
-
-	var lnk *Link
-	var ok bool
-	switch keylen := len(key); {
-	case keylen == 1:
-		domainLinkLens[r.Host].LinkLen1.Mutex.RLock()
-		if lnk, ok = domainLinkLens[r.Host].LinkLen1.LinkMap[key]; !ok {
-			domainLinkLens[r.Host].LinkLen1.Mutex.RUnlock()
-			http.Error(w, errInvalidKey, http.StatusInternalServerError)
-			return
-		}
-		domainLinkLens[r.Host].LinkLen1.Mutex.RUnlock()
-	case keylen == 2:
-		domainLinkLens[r.Host].LinkLen2.Mutex.RLock()
-		if lnk, ok = domainLinkLens[r.Host].LinkLen2.LinkMap[key]; !ok {
-			domainLinkLens[r.Host].LinkLen2.Mutex.RUnlock()
-			http.Error(w, errInvalidKey, http.StatusInternalServerError)
-			return
-		}
-		domainLinkLens[r.Host].LinkLen2.Mutex.RUnlock()
-	case keylen == 3:
-		domainLinkLens[r.Host].LinkLen3.Mutex.RLock()
-		if lnk, ok = domainLinkLens[r.Host].LinkLen3.LinkMap[key]; !ok {
-			domainLinkLens[r.Host].LinkLen3.Mutex.RUnlock()
-			http.Error(w, errInvalidKey, http.StatusInternalServerError)
+	linkLen, lnk, goneMsg := findLink(r.Host, key)
+	if lnk == nil {
+		if ok, retryAfter := limiters.FailedLookup.Allow(rateLimitKey(r)); !ok {
+			tooManyRequests(w, r, retryAfter, "FailedLookup")
 			return
 		}
-		domainLinkLens[r.Host].LinkLen3.Mutex.RUnlock()
-	case keylen > 3 && keylen < maxKeyLen:
-		// key is validated previously
-		domainLinkLens[r.Host].LinkCustom.Mutex.RLock()
-		if lnk, ok = domainLinkLens[r.Host].LinkCustom.LinkMap[key]; !ok {
-			domainLinkLens[r.Host].LinkCustom.Mutex.RUnlock()
-			http.Error(w, errInvalidKey, http.StatusInternalServerError)
+		if goneMsg != "" {
+			logErrors(w, r, goneMsg, http.StatusGone, "")
 			return
 		}
-		domainLinkLens[r.Host].LinkCustom.Mutex.RUnlock()
-	default:
-		http.Error(w, errInvalidKey, http.StatusInternalServerError)
+		logErrors(w, r, errKeyNotFound, http.StatusNotFound, "")
 		return
 	}
 
-	if lnk == nil {
-		http.Error(w, errInvalidKey, http.StatusInternalServerError)
+	// new revisions are authorized by the edit secret instead of the password of the link, defined in revisions.go
+	rest := strings.TrimPrefix(r.URL.Path, "/"+key)
+	if rest == "/revise" && lnk.LinkType == "text" {
+		reviseText(w, r, linkLen, lnk, key)
 		return
 	}
 
+	if showLink && lnk.PasswordHash != "" {
+		logOK(r, http.StatusOK)
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, r.Host+"/"+key+"\n\nis protected by a password")
+		return
+	}
+	if !unlockLink(w, r, linkLen, lnk, key) { // defined in unlock.go
+		return
+	}
+	if lnk.PasswordHash != "" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	// links created with xTimes are removed after the last allowed read, the ~ view does not count and burn after reading texts are
+	// removed when they are revealed
+	if !showLink && !lnk.BurnAfterReading {
+		linkLen.Mutex.RLock()
+		limited := lnk.Times > 0
+		linkLen.Mutex.RUnlock()
+		ok, removed := linkLen.countRead(key, lnk) // defined in types.go
+		if !ok {
+			logErrors(w, r, errLinkExpired, http.StatusGone, "")
+			return
+		}
+		if removed {
+			go saveLinkLenBackup(linkLen) // defined in db.go
+		}
+		if limited {
+			// a cached answer would not be counted
+			w.Header().Set("Cache-Control", "no-store")
+		}
+	}
+
 	switch lnk.LinkType {
 	case "url":
 		if showLink {
 			logOK(r, http.StatusOK)
 			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			if lnk.Prefix {
+				fmt.Fprint(w, r.Host+"/"+key+"/...\n\nis pointing to \n\n"+html.EscapeString(lnk.Data)+"...")
+				return
+			}
 			fmt.Fprint(w, r.Host+"/"+key+"\n\nis pointing to \n\n"+html.EscapeString(lnk.Data))
 			return
 		}
-		w.Header().Add("Content-Type", "text/html; charset=utf-8")
-		t, ok := templateMap[r.Host+"#showLink"]
-		if !ok {
-			http.Error(w, errServerError, http.StatusInternalServerError)
-		}
-		tmplArgs := showLinkVars{Domain: scheme + "://" + r.Host, Data: lnk.Data, Timeout: lnk.Timeout.Format("Mon 2006-01-02 15:04 MST")}
-		err := t.ExecuteTemplate(w, "showLink.tmpl", tmplArgs)
-		if err != nil {
-			http.Error(w, errServerError, http.StatusInternalServerError)
+		target := lnk.Data
+		if lnk.Prefix {
+			var err error
+			if target, err = prefixTarget(lnk.Data, r); err != nil { // defined in redirect.go
+				logErrors(w, r, err.Error(), statusFor(err.Error()), "")
+				return
+			}
 		}
-		logOK(r, http.StatusTemporaryRedirect)
+		serveURLLink(w, r, lnk, target) // defined in redirect.go
 		return
-	case "text":
-		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	case "text", "encrypted":
+		// texts can be revised, the copy is not changed by a new revision while it is served. Defined in revisions.go
+		snap := linkLen.snapshot(lnk)
+		lnk = &snap
 		if showLink {
 			logOK(r, http.StatusOK)
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			if lnk.LinkType == "encrypted" {
+				fmt.Fprint(w, r.Host+"/"+key+"\n\nis pointing to an encrypted "+r.Host+" Text dump")
+				return
+			}
 			fmt.Fprint(w, r.Host+"/"+key+"\n\nis pointing to a "+r.Host+" Text dump")
 			return
 		}
+		if lnk.BurnAfterReading {
+			// only an explicit reveal removes the link, a password that unlocked the link counts as explicit. Defined in reveal.go
+			if r.Method != http.MethodPost && lnk.PasswordHash == "" {
+				writeRevealPage(w, r, key)
+				return
+			}
+			if _, ok := linkLen.Remove(key, errLinkBurned); !ok {
+				logErrors(w, r, errLinkBurned, http.StatusGone, "")
+				return
+			}
+			go saveLinkLenBackup(linkLen) // defined in db.go
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if lnk.LinkType == "encrypted" {
+			serveEncrypted(w, r, lnk) // defined in encrypted.go
+			return
+		}
+		if rest == "/diff" {
+			serveDiff(w, r, lnk, key) // defined in diff.go
+			return
+		}
+		if wantsPasteView(r, key) {
+			servePaste(w, r, lnk, key) // defined in paste.go
+			return
+		}
+		if rev, ok := requestedRevision(r, lnk); ok && rev != currentRevision(lnk) {
+			// older revisions are only available decompressed, defined in revisions.go
+			text, ok := revisionText(lnk, rev)
+			if !ok {
+				logErrors(w, r, errRevisionNotFound, http.StatusNotFound, "")
+				return
+			}
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			logOK(r, http.StatusOK)
+			fmt.Fprint(w, text)
+			return
+		}
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
 		if lnk.IsCompressed {
 			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 				w.Header().Add("content-encoding", "gzip")
@@ -350,13 +596,52 @@ func handleGET(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleCSS(mux *http.ServeMux) {
-	f, err := ioutil.ReadFile(filepath.Join(config.BaseDir, "css", "shorter.css"))
-	if err != nil {
-		log.Fatalln("Missing shorter.css in Template dir/css/")
+// findLink returns the link with key on domain and the LinkLen that contains it, if no link exists goneMsg contains the reason if the key was removed recently
+func findLink(domain, key string) (linkLen *LinkLen, lnk *Link, goneMsg string) {
+	switch keylen := len(key); {
+	case keylen == 1:
+		linkLen = &domainLinkLens[domain].LinkLen1
+	case keylen == 2:
+		linkLen = &domainLinkLens[domain].LinkLen2
+	case keylen == 3:
+		linkLen = &domainLinkLens[domain].LinkLen3
+	case keylen > 3 && keylen < maxKeyLen:
+		// key is validated previously
+		linkLen = &domainLinkLens[domain].LinkCustom
+	default:
+		return nil, nil, ""
 	}
 
-	mux.HandleFunc("/shorter.css", getSingleFileHandler(f, "text/css"))
+	linkLen.Mutex.RLock()
+	defer linkLen.Mutex.RUnlock()
+	lnk = linkLen.LinkMap[key]
+	if gone, ok := linkLen.Gone[key]; ok && lnk == nil {
+		goneMsg = gone.Message
+	}
+	return linkLen, lnk, goneMsg
+}
+
+// getDomainFileHandler returns a handler that serves the asset name for the requested domain
+func getDomainFileHandler(name, mimeType string) func(w http.ResponseWriter, r *http.Request) {
+	handlers := make(map[string]func(w http.ResponseWriter, r *http.Request))
+	for _, domain := range config.DomainNames {
+		f, source, err := readAsset(domain, name) // defined in assets.go
+		if err != nil {
+			log.Fatalln("Unable to read "+source+":", err)
+		}
+		if logger != nil {
+			logger.Println("Loaded /" + domain + "/" + name + " from " + source)
+		}
+		handlers[domain] = getSingleFileHandler(f, mimeType)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := handlers[r.Host]; ok {
+			handler(w, r)
+			return
+		}
+		addHeaders(w, r)
+		http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
+	}
 }
 
 func getSingleFileHandler(f []byte, mimeType string) (handleFile func(w http.ResponseWriter, r *http.Request)) {
@@ -383,7 +668,7 @@ func getSingleFileHandler(f []byte, mimeType string) (handleFile func(w http.Res
 			fmt.Fprintf(w, "%s", f)
 			return
 		}
-		http.Error(w, errServerError, http.StatusInternalServerError)
+		http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 	}
 	return
 }
@@ -397,37 +682,25 @@ func getImgHandler(img string, mimeType string) (handleImgFile func(w http.Respo
 			fmt.Fprintf(w, "%s", ImageMap[r.Host+img])
 			return
 		}
-		http.Error(w, errServerError, http.StatusInternalServerError)
+		http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 	}
 	return
 }
 
-// handleImages adds /logo.png, /favicon.ico and /favicon.png to all domains specified in config, if a domain is missing a image it will fall back to the default image
+// handleImages adds /logo.png, /favicon.ico and /favicon.png to all domains specified in config, if a domain is missing a image it will fall back to the image from the built-in theme
 func handleImages(mux *http.ServeMux) {
 	ImageMap = make(map[string][]byte)
 
-	defaultLogo := []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x80, 0x04, 0x03, 0x00, 0x00, 0x00, 0x31, 0x10, 0x7c, 0xf8, 0x00, 0x00, 0x00, 0x0f, 0x50, 0x4c, 0x54, 0x45, 0x00, 0x00, 0x00, 0x17, 0x9c, 0xf2, 0x8a, 0xc2, 0xf3, 0xb7, 0xda, 0xf8, 0xfd, 0xff, 0xfc, 0x73, 0x3f, 0xef, 0xad, 0x00, 0x00, 0x00, 0x01, 0x74, 0x52, 0x4e, 0x53, 0x00, 0x40, 0xe6, 0xd8, 0x66, 0x00, 0x00, 0x02, 0x10, 0x49, 0x44, 0x41, 0x54, 0x68, 0xde, 0xed, 0xda, 0x5d, 0x76, 0x82, 0x30, 0x10, 0x86, 0x61, 0xbb, 0x83, 0x26, 0xb0, 0x01, 0x94, 0x0d, 0x50, 0xdd, 0x00, 0x98, 0xfd, 0xaf, 0xa9, 0xca, 0x4f, 0x14, 0x4f, 0x66, 0xbe, 0x2f, 0x33, 0x17, 0xde, 0x90, 0x3b, 0x7b, 0xe0, 0x39, 0xe1, 0x4d, 0xe0, 0xd4, 0xd2, 0xd3, 0xe9, 0x39, 0x82, 0x69, 0x9c, 0xb6, 0xf1, 0x63, 0x3b, 0x3f, 0x84, 0x5f, 0xe7, 0xf9, 0x9b, 0x60, 0x3f, 0x7f, 0xb9, 0x0a, 0xc7, 0x04, 0x96, 0x29, 0x78, 0xce, 0x9f, 0xa7, 0xe0, 0x05, 0x5c, 0x57, 0xf0, 0xbc, 0x86, 0xef, 0x03, 0xbe, 0xf3, 0x1f, 0x11, 0x0e, 0xe0, 0x00, 0xac, 0xc0, 0xf9, 0xdc, 0x79, 0x80, 0x78, 0x4b, 0x29, 0xfd, 0xd9, 0x81, 0x98, 0xe6, 0x31, 0x99, 0x81, 0x7e, 0x01, 0x52, 0x67, 0x04, 0xd6, 0x09, 0xe4, 0x29, 0x2c, 0x40, 0x3c, 0x33, 0x63, 0x3e, 0xb4, 0xdd, 0x80, 0xf4, 0x0e, 0x34, 0x89, 0x18, 0xd3, 0xee, 0x0a, 0xb6, 0x6b, 0xa8, 0x00, 0xc6, 0xf9, 0xd0, 0x5b, 0xfe, 0x3c, 0xd4, 0x02, 0x83, 0x17, 0x08, 0x4e, 0x60, 0xf2, 0x02, 0x63, 0xf8, 0x88, 0x58, 0x0b, 0xac, 0x1b, 0xc7, 0xbe, 0x8c, 0xeb, 0x46, 0xca, 0x87, 0x4e, 0x95, 0xc0, 0xb6, 0xf7, 0x73, 0x84, 0xa1, 0x12, 0x18, 0xc3, 0x7e, 0x0a, 0xfb, 0x9b, 0x89, 0x00, 0x5e, 0x4f, 0x80, 0xcb, 0xf3, 0xe3, 0xbd, 0xab, 0x04, 0xee, 0xef, 0xf7, 0xd3, 0xf5, 0x9a, 0x1f, 0x07, 0x34, 0x30, 0x05, 0x61, 0xb0, 0xc0, 0xa0, 0x03, 0x8f, 0x49, 0x95, 0x47, 0x21, 0x41, 0x11, 0x90, 0x46, 0x7e, 0x7a, 0xdc, 0x83, 0x0d, 0x68, 0x60, 0x02, 0x00, 0xf4, 0x30, 0x01, 0x00, 0x70, 0x02, 0x1d, 0x20, 0x12, 0xe8, 0x40, 0x5b, 0x4a, 0x70, 0x59, 0x17, 0x88, 0x79, 0xac, 0x17, 0x13, 0xf4, 0xfb, 0x9f, 0xa9, 0x40, 0x4e, 0x10, 0x6c, 0x40, 0x79, 0x11, 0x2b, 0x80, 0x7c, 0x05, 0xa3, 0x11, 0xb8, 0x95, 0x12, 0x54, 0x00, 0xb1, 0x98, 0xa0, 0x02, 0x10, 0xf6, 0x31, 0x0f, 0x94, 0x13, 0x54, 0x00, 0xe5, 0x04, 0x3c, 0x20, 0x24, 0xe0, 0x81, 0xb6, 0x9c, 0x80, 0x07, 0x84, 0x04, 0x3c, 0x20, 0xdd, 0xca, 0x2c, 0x90, 0x17, 0xf1, 0xf3, 0x56, 0x66, 0x81, 0x5e, 0x48, 0x40, 0x03, 0xc2, 0x22, 0xd2, 0x40, 0x94, 0x12, 0xb0, 0x80, 0x98, 0x80, 0x05, 0xc4, 0x04, 0x2c, 0x20, 0x26, 0x20, 0x01, 0x39, 0x01, 0x09, 0xb4, 0x62, 0x02, 0x12, 0x90, 0x13, 0x90, 0x40, 0x12, 0x13, 0x70, 0xc0, 0xeb, 0xf7, 0x85, 0x60, 0x03, 0x94, 0x04, 0x1c, 0x90, 0x17, 0x71, 0xb4, 0x01, 0x51, 0x49, 0x40, 0x01, 0x5a, 0x02, 0x0a, 0x50, 0x16, 0x91, 0x03, 0xb4, 0x04, 0x0c, 0xa0, 0xec, 0x63, 0x0e, 0x50, 0x13, 0x30, 0x80, 0x9a, 0x80, 0x01, 0x92, 0x96, 0x80, 0x00, 0x1a, 0x35, 0x01, 0x01, 0x68, 0xfb, 0x98, 0x02, 0xf4, 0x04, 0x04, 0xa0, 0xed, 0x63, 0x06, 0x00, 0x09, 0x30, 0xd0, 0xeb, 0x09, 0x30, 0x70, 0xd3, 0x13, 0x40, 0x20, 0x82, 0x04, 0x10, 0x40, 0x09, 0x20, 0x80, 0x12, 0x40, 0x20, 0x81, 0x04, 0x08, 0x80, 0x09, 0x10, 0xf0, 0xf9, 0xe5, 0xbc, 0x1a, 0x80, 0x09, 0x10, 0xa0, 0xdf, 0xca, 0x18, 0x68, 0x60, 0x02, 0x00, 0xf4, 0x30, 0x01, 0x00, 0xd0, 0x3e, 0x46, 0x40, 0xc4, 0x09, 0x74, 0x80, 0x48, 0xa0, 0x03, 0x44, 0x02, 0x1d, 0x20, 0x12, 0xa8, 0x00, 0x93, 0x40, 0x05, 0x5e, 0xfb, 0xb8, 0xb3, 0x01, 0x78, 0x1f, 0x03, 0x00, 0xde, 0xca, 0x00, 0x60, 0x16, 0x51, 0x07, 0xf2, 0xdf, 0x5e, 0x94, 0x04, 0x55, 0x5f, 0xff, 0x99, 0x71, 0x00, 0x07, 0x30, 0x03, 0xdf, 0x7f, 0xdb, 0xe7, 0x06, 0xbe, 0xff, 0xce, 0xd5, 0xff, 0xda, 0xd8, 0xfd, 0xe2, 0xda, 0xff, 0xea, 0xdc, 0xfd, 0xf2, 0xde, 0xf7, 0xef, 0x03, 0xff, 0x2b, 0xec, 0x86, 0x52, 0x86, 0x8e, 0xac, 0x41, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82}
-	defaultFavicon := []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x10, 0x08, 0x03, 0x00, 0x00, 0x00, 0x28, 0x2d, 0x0f, 0x53, 0x00, 0x00, 0x00, 0x9c, 0x50, 0x4c, 0x54, 0x45, 0x1f, 0x9b, 0xed, 0x1f, 0x9b, 0xef, 0x1e, 0x9a, 0xed, 0x1e, 0x9c, 0xed, 0x1f, 0x9b, 0xee, 0x1f, 0x9c, 0xef, 0x20, 0x9c, 0xee, 0x20, 0x9c, 0xee, 0x21, 0x9c, 0xee, 0x23, 0x9d, 0xee, 0x26, 0x9e, 0xee, 0x28, 0x9f, 0xee, 0x2a, 0xa0, 0xee, 0x2e, 0xa2, 0xef, 0x31, 0xa3, 0xef, 0x37, 0xa6, 0xef, 0x39, 0xa7, 0xef, 0x45, 0xac, 0xf0, 0x55, 0xb3, 0xf1, 0x5e, 0xb7, 0xf2, 0x62, 0xb9, 0xf3, 0x63, 0xb9, 0xf2, 0x65, 0xba, 0xf2, 0x6e, 0xbe, 0xf3, 0x77, 0xc2, 0xf4, 0x78, 0xc2, 0xf4, 0x81, 0xc7, 0xf5, 0x87, 0xc9, 0xf5, 0x8a, 0xca, 0xf5, 0x8b, 0xcb, 0xf5, 0x91, 0xce, 0xf6, 0x96, 0xd0, 0xf6, 0x99, 0xd1, 0xf6, 0x9b, 0xd2, 0xf6, 0x9b, 0xd2, 0xf7, 0x9d, 0xd3, 0xf7, 0x9f, 0xd4, 0xf7, 0xb9, 0xe0, 0xf9, 0xcb, 0xe7, 0xfa, 0xd7, 0xed, 0xfb, 0xda, 0xee, 0xfb, 0xdf, 0xf0, 0xfc, 0xe5, 0xf3, 0xfc, 0xe7, 0xf4, 0xfc, 0xeb, 0xf6, 0xfd, 0xed, 0xf7, 0xfd, 0xf0, 0xf8, 0xfd, 0xf1, 0xf8, 0xfd, 0xf2, 0xf9, 0xfd, 0xf5, 0xfa, 0xfe, 0xf9, 0xfc, 0xfe, 0xff, 0xff, 0xff, 0x7a, 0x52, 0xe8, 0x58, 0x00, 0x00, 0x00, 0x07, 0x74, 0x52, 0x4e, 0x53, 0x7d, 0x7d, 0x7e, 0x7e, 0xf8, 0xf8, 0xf9, 0x01, 0xb6, 0xcf, 0xc8, 0x00, 0x00, 0x00, 0x7e, 0x49, 0x44, 0x41, 0x54, 0x18, 0x57, 0x55, 0xcf, 0xc7, 0x12, 0x82, 0x40, 0x10, 0x84, 0xe1, 0x51, 0x59, 0x7f, 0xd7, 0x84, 0x62, 0x00, 0x23, 0x06, 0xcc, 0x71, 0x9d, 0xf7, 0x7f, 0x37, 0x2f, 0x50, 0x35, 0xf4, 0xad, 0xbf, 0xaa, 0x3e, 0xb4, 0xb4, 0x1c, 0x26, 0xae, 0x21, 0x6d, 0xdb, 0x21, 0x12, 0xdb, 0x26, 0xdb, 0x18, 0x21, 0x7f, 0x95, 0x59, 0xf1, 0xd1, 0x3d, 0xc2, 0x21, 0x84, 0x10, 0xc2, 0x4f, 0xdf, 0x03, 0x66, 0xf9, 0x88, 0x6a, 0x72, 0xd6, 0x0d, 0x24, 0x69, 0x5c, 0xc1, 0x5c, 0x9f, 0x7d, 0x38, 0xe9, 0xb4, 0x04, 0x7f, 0xd5, 0x25, 0x16, 0x32, 0xbd, 0x77, 0x2d, 0xf4, 0x1e, 0xba, 0xc0, 0xc2, 0x5a, 0x6f, 0xde, 0xc2, 0xf0, 0xab, 0x29, 0x16, 0x8e, 0x7a, 0xe9, 0x58, 0xf0, 0xbb, 0x22, 0x01, 0x80, 0xac, 0x18, 0x23, 0xb5, 0xb3, 0xe0, 0xa4, 0x59, 0x93, 0x48, 0xfe, 0x29, 0x72, 0x10, 0x99, 0xc7, 0x5c, 0x2b, 0x48, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82}
-
 	for _, domain := range config.DomainNames {
-		logo, err := ioutil.ReadFile(filepath.Join(config.BaseDir, domain, "logo.png"))
-		if err != nil {
-			if logger != nil {
-				logger.Println("Missing /" + domain + "/logo.png in Template dir, fallback to default logo.png")
+		for _, img := range []string{"logo", "favicon"} {
+			data, source, err := readAsset(domain, img+".png") // defined in assets.go
+			if err != nil {
+				log.Fatalln("Unable to read "+source+":", err)
 			}
-			ImageMap[domain+"-logo"] = defaultLogo
-		} else {
-			ImageMap[domain+"-logo"] = logo
-		}
-
-		favicon, err := ioutil.ReadFile(filepath.Join(config.BaseDir, domain, "favicon.png"))
-		if err != nil {
 			if logger != nil {
-				logger.Println("Missing /" + domain + "/favicon.png in Template dir, fallback to default favicon.png")
+				logger.Println("Loaded /" + domain + "/" + img + ".png from " + source)
 			}
-			ImageMap[domain+"-favicon"] = defaultFavicon
-		} else {
-			ImageMap[domain+"-favicon"] = favicon
+			ImageMap[domain+"-"+img] = data
 		}
 	}
 
@@ -436,43 +709,27 @@ func handleImages(mux *http.ServeMux) {
 	mux.HandleFunc("/favicon.ico", getImgHandler("-favicon", "image/png"))
 }
 
-// handleRobots will return the robots.txt located in the Template dir specified in the config file, if no robots.txt file is found we return a 404 error
+// handleRobots adds /robots.txt to all domains specified in config, if a domain does not override robots.txt the built-in theme is used
 func handleRobots(mux *http.ServeMux) {
-	f, err := ioutil.ReadFile(filepath.Join(config.BaseDir, "robots.txt"))
-	if err != nil {
-		if logger != nil {
-			logger.Println("Missing robots.txt in Template dir, fallback to returning 404 on requests for robots.txt")
-		}
-		handler404 := func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "Not Found", http.StatusNotFound)
-		}
-		mux.HandleFunc("/robots.txt", handler404)
-		return
-	}
-	handleRobots := func(w http.ResponseWriter, r *http.Request) {
-		addHeaders(w, r)
-		if validRequest(r) {
-			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-			w.Header().Add("Cache-Control", "max-age=2592000, public")
-			fmt.Fprintf(w, "%s", f)
-			return
-		}
-		http.Error(w, errServerError, http.StatusInternalServerError)
-	}
-	mux.HandleFunc("/robots.txt", handleRobots)
+	mux.HandleFunc("/robots.txt", getDomainFileHandler("robots.txt", "text/plain; charset=utf-8"))
 }
 
 func quickAddURL(w http.ResponseWriter, r *http.Request, url, key string) {
 	var urlLink *LinkLen
+	var lastErr error
 
 	// Remove keys of invalid size, note that key has been validated to only contain valid characters previously
 	if len(key) <= 3 || len(key) >= maxKeyLen {
 		key = ""
 	}
 
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+	scheme := requestScheme(r)
+
+	// quick add takes the optional password from the X-Link-Password header, defined in unlock.go
+	passwordHash, errMsg := linkPasswordHash(r)
+	if errMsg != "" {
+		logErrors(w, r, errMsg, statusFor(errMsg), "")
+		return
 	}
 
 	// Try to quickAddURL for first len 1, if all are full then try len 2 and lastly len 3
@@ -483,8 +740,11 @@ func quickAddURL(w http.ResponseWriter, r *http.Request, url, key string) {
 				continue
 			}
 			urlLink = &domainLinkLens[r.Host].LinkCustom
-			if _, used := urlLink.LinkMap[key]; used {
-				http.Error(w, errInvalidKeyUsed, http.StatusInternalServerError)
+			urlLink.Mutex.RLock()
+			_, used := urlLink.LinkMap[key]
+			urlLink.Mutex.RUnlock()
+			if used {
+				logErrors(w, r, errInvalidKeyUsed, http.StatusConflict, "")
 				return
 			}
 		case 1:
@@ -502,23 +762,51 @@ func quickAddURL(w http.ResponseWriter, r *http.Request, url, key string) {
 
 		isCompressed := false
 
-		showLink := &Link{Key: key, LinkType: "url", Data: url, IsCompressed: isCompressed, Times: -1, Timeout: time.Now().Add(linkTimeout)}
-		_, err := urlLink.Add(showLink)
+		showLink := &Link{Key: key, LinkType: "url", Data: url, IsCompressed: isCompressed, Times: -1, PasswordHash: passwordHash, Timeout: time.Now().Add(linkTimeout)}
+		newKey, err := urlLink.Add(showLink)
 		if err == nil {
+			if writeCreated(w, r, createdResponse{URL: scheme + "://" + r.Host + "/" + newKey, Expires: showLink.Timeout}) {
+				return
+			}
 			w.Header().Add("Content-Type", "text/html; charset=utf-8")
 			t, ok := templateMap[r.Host+"#showLink"]
 			if !ok {
-				http.Error(w, errServerError, http.StatusInternalServerError)
+				http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 				return
 			}
 
-			tmplArgs := showLinkVars{Domain: scheme + "://" + r.Host, Data: showLink.Data, Timeout: showLink.Timeout.Format("Mon 2006-01-02 15:04 MST")}
+			tmplArgs := newShowLinkVars(r, scheme, showLink.Data, showLink.Timeout)
 			err = t.ExecuteTemplate(w, "showLink.tmpl", tmplArgs)
 			if err != nil {
-				http.Error(w, errServerError, http.StatusInternalServerError)
+				http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 			}
 			logOK(r, http.StatusOK)
 			return
 		}
+		lastErr = err
+	}
+	addFailed(w, r, lastErr) // defined in errors.go
+}
+
+// createdResponse is the body of the answer to API clients that accept application/json when a link has been created
+type createdResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	// Revision is the number of the new revision of a text, defined in revisions.go
+	Revision int `json:"revision,omitempty"`
+	// EditSecret is required to add revisions to a new text, it is only returned once
+	EditSecret string `json:"edit_secret,omitempty"`
+}
+
+// writeCreated answers clients that accept application/json with a createdResponse and returns true, for all other clients nothing is written
+func writeCreated(w http.ResponseWriter, r *http.Request, created createdResponse) bool {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(created); err != nil && logger != nil {
+		logger.Println("Unable to write JSON response:", err)
 	}
+	logOK(r, http.StatusOK)
+	return true
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// buildVersion and buildCommit can be set when building, e.g. go build -ldflags "-X main.buildVersion=v1.2.3 -X main.buildCommit=$(git rev-parse HEAD)"
+var buildVersion, buildCommit string
+
+// persistenceCheckInterval is the time between the checks that the backup directories are writable, the result is cached so that probes
+// do not write to the disk
+const persistenceCheckInterval = 30 * time.Second
+
+// readiness tracks the startup steps that have to finish before shorter is ready to serve requests, use setReady and isReady to access the fields.
+// serving is set once the servers are started and cleared again when shorter is shutting down, netcat is set while the optional netcat
+// listener accepts connections
+var readiness struct {
+	linkLensRestored int32
+	templatesLoaded  int32
+	serving          int32
+	netcat           int32
+}
+
+// persistenceResult holds the result of the last persistence check, an atomic.Value can not store a nil error
+type persistenceResult struct {
+	err error
+}
+
+// lastPersistenceCheck contains the persistenceResult of the last check by persistenceCheckRoutine
+var lastPersistenceCheck atomic.Value
+
+func setReady(step *int32) {
+	atomic.StoreInt32(step, 1)
+}
+
+func setNotReady(step *int32) {
+	atomic.StoreInt32(step, 0)
+}
+
+func isReady(step *int32) bool {
+	return atomic.LoadInt32(step) == 1
+}
+
+// handleHealth adds /healthz, /readyz and /version for all hosts, note that the Host is not validated since orchestrators usually connect directly to the IP
+func handleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/version", handleVersion)
+}
+
+// handleHealthz reports that the process is alive and able to serve requests
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Cache-Control", "no-store")
+	fmt.Fprint(w, "ok\n")
+}
+
+// handleReadyz reports 200 if all links have been restored, the templates are loaded, the backup directories are writable and shorter is not low on RAM,
+// otherwise 503 is returned together with the failed checks. Add ?verbose to list all checks
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	checks := readinessChecks()
+	ready := true
+	var resp strings.Builder
+	for _, check := range checks {
+		if check.err != nil {
+			ready = false
+			fmt.Fprintf(&resp, "[-] %s failed: %s\n", check.name, check.err)
+		} else if _, verbose := r.URL.Query()["verbose"]; verbose {
+			fmt.Fprintf(&resp, "[+] %s ok\n", check.name)
+		}
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Cache-Control", "no-store")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, resp.String()+"not ready\n")
+		return
+	}
+	fmt.Fprint(w, resp.String()+"ok\n")
+}
+
+// readinessCheck is the result of a single readiness check, err is nil if the check passed
+type readinessCheck struct {
+	name string
+	err  error
+}
+
+func readinessChecks() (checks []readinessCheck) {
+	add := func(name string, err error) {
+		checks = append(checks, readinessCheck{name: name, err: err})
+	}
+	if isReady(&readiness.linkLensRestored) {
+		add("links restored", nil)
+	} else {
+		add("links restored", fmt.Errorf("links are still being restored"))
+	}
+	if isReady(&readiness.templatesLoaded) {
+		add("templates loaded", nil)
+	} else {
+		add("templates loaded", fmt.Errorf("templates are still being loaded"))
+	}
+	if isReady(&readiness.serving) {
+		add("serving", nil)
+	} else {
+		add("serving", fmt.Errorf("the servers are not started or shutting down"))
+	}
+	if config.Netcat.Address != "" {
+		if isReady(&readiness.netcat) {
+			add("netcat listener", nil)
+		} else {
+			add("netcat listener", fmt.Errorf("the netcat listener is not accepting connections"))
+		}
+	}
+	if result, ok := lastPersistenceCheck.Load().(persistenceResult); ok {
+		add("persistence writable", result.err)
+	} else {
+		add("persistence writable", fmt.Errorf("the backup directories have not been checked yet"))
+	}
+	if lowRAM() {
+		add("memory", fmt.Errorf("RAM usage is above MaxRAM"))
+	} else {
+		add("memory", nil)
+	}
+	return checks
+}
+
+// persistenceCheckRoutine checks that the backup directories are writable every persistenceCheckInterval, start it in a separate goroutine
+func persistenceCheckRoutine() {
+	for {
+		lastPersistenceCheck.Store(persistenceResult{err: checkPersistenceWritable()})
+		time.Sleep(persistenceCheckInterval)
+	}
+}
+
+// checkPersistenceWritable verifies that a file can be created in the backup directory of every domain
+func checkPersistenceWritable() error {
+	for _, domain := range config.DomainNames {
+		f, err := ioutil.TempFile(filepath.Join(config.BaseDir, domain), ".readyz-")
+		if err != nil {
+			return fmt.Errorf("unable to write to the backup directory for %s", domain)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return nil
+}
+
+// handleVersion returns the version, commit and Go version of the running binary as JSON. The modules the binary was built with are not
+// shown since the endpoint is public
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	version := struct {
+		Version   string `json:"Version"`
+		Commit    string `json:"Commit,omitempty"`
+		GoVersion string `json:"GoVersion"`
+	}{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		GoVersion: runtime.Version(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && version.Version == "" {
+		version.Version = info.Main.Version
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(version)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// langPlain is shown without highlighting
+	langPlain = "text"
+	// langMarkdown is rendered as HTML in the paste view, defined in markdown.go
+	langMarkdown = "markdown"
+	// maxHighlightLen is the longest text that is highlighted, longer texts are shown as plain text to keep the paste view fast
+	maxHighlightLen = 1 << 20
+)
+
+// langDef describes the tokens of a language for the highlighter, the highlighter is deliberately simple and only knows keywords,
+// comments, strings and numbers
+type langDef struct {
+	// Name is shown in the paste view and in the language select of the index page
+	Name string
+	// Keywords are highlighted as keywords when they appear as whole words
+	Keywords map[string]bool
+	// LineComments start a comment that ends at the end of the line
+	LineComments []string
+	// BlockComment contains the start and end of a comment that can span lines
+	BlockComment [2]string
+	// Quotes are the characters that start and end a string
+	Quotes string
+	// MultilineQuotes are the quotes of strings that can span lines, e.g. ` in Go and JavaScript
+	MultilineQuotes string
+	// Keys highlights strings and words that are followed by a : as keys, e.g. in JSON and YAML
+	Keys bool
+}
+
+// token is a part of a highlighted text, Class is the css class of the token and empty for plain text
+type token struct {
+	Class string
+	Text  string
+}
+
+// pasteLine is a line of a highlighted text, N is the line number starting at 1
+type pasteLine struct {
+	N      int
+	Tokens []token
+}
+
+// words returns a set of the space separated words in s
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+// languages contains the languages of the highlighter, the keys are the values of the lang form field and query parameter
+var languages = map[string]*langDef{
+	langPlain:    {Name: "Plain text"},
+	langMarkdown: {Name: "Markdown"},
+	"go": {Name: "Go", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, Quotes: "\"'", MultilineQuotes: "`",
+		Keywords: words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota")},
+	"python": {Name: "Python", LineComments: []string{"#"}, Quotes: "\"'",
+		Keywords: words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self")},
+	"javascript": {Name: "JavaScript", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, Quotes: "\"'", MultilineQuotes: "`",
+		Keywords: words("async await break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new of return super switch this throw try typeof var void while with yield null undefined true false")},
+	"java": {Name: "Java", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, Quotes: "\"'",
+		Keywords: words("abstract boolean break byte case catch char class continue default do double else enum extends final finally float for if implements import instanceof int interface long new package private protected public return short static super switch this throw throws try void volatile while null true false var")},
+	"c": {Name: "C", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, Quotes: "\"'",
+		Keywords: words("auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while NULL #include #define #ifdef #ifndef #endif #if #else")},
+	"rust": {Name: "Rust", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, Quotes: "\"",
+		Keywords: words("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while")},
+	"shell": {Name: "Shell", LineComments: []string{"#"}, Quotes: "\"'",
+		Keywords: words("if then else elif fi for while until do done case esac in function return local export set unset echo exit")},
+	"sql": {Name: "SQL", LineComments: []string{"--"}, BlockComment: [2]string{"/*", "*/"}, Quotes: "'\"",
+		Keywords: words("select from where insert into values update set delete create table drop alter index join left right inner outer on and or not null is as order by group having limit offset union distinct primary key references SELECT FROM WHERE INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER INDEX JOIN LEFT RIGHT INNER OUTER ON AND OR NOT NULL IS AS ORDER BY GROUP HAVING LIMIT OFFSET UNION DISTINCT PRIMARY KEY REFERENCES")},
+	"json": {Name: "JSON", Quotes: "\"", Keys: true, Keywords: words("true false null")},
+	"yaml": {Name: "YAML", LineComments: []string{"#"}, Quotes: "\"'", Keys: true, Keywords: words("true false null yes no")},
+}
+
+// languageOrder contains the keys of languages in the order they are shown in the language select
+var languageOrder = []string{langPlain, langMarkdown, "go", "python", "javascript", "java", "c", "rust", "shell", "sql", "json", "yaml"}
+
+// languageOption is an entry of the language select on the index page
+type languageOption struct {
+	Value, Name string
+}
+
+// languageOptions returns the languages in the order they are shown in the language select
+func languageOptions() []languageOption {
+	options := make([]languageOption, 0, len(languageOrder))
+	for _, lang := range languageOrder {
+		options = append(options, languageOption{Value: lang, Name: languages[lang].Name})
+	}
+	return options
+}
+
+// detectLanguage guesses the language of text from a few characteristic lines, langPlain is returned if no language matches
+func detectLanguage(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return langPlain
+	}
+	firstLine := trimmed
+	if i := strings.IndexByte(trimmed, '\n'); i >= 0 {
+		firstLine = trimmed[:i]
+	}
+	if strings.HasPrefix(firstLine, "#!") {
+		switch {
+		case strings.Contains(firstLine, "python"):
+			return "python"
+		case strings.Contains(firstLine, "node"):
+			return "javascript"
+		default:
+			return "shell"
+		}
+	}
+	if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+	score := map[string]int{}
+	for _, line := range strings.Split(trimmed, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "package ") || strings.HasPrefix(line, "func ") || strings.Contains(line, ":= "):
+			score["go"]++
+		case strings.HasPrefix(line, "def ") || strings.HasPrefix(line, "class ") && strings.HasSuffix(line, ":") || strings.HasPrefix(line, "from ") && strings.Contains(line, " import "):
+			score["python"]++
+		case strings.HasPrefix(line, "#include") || strings.HasPrefix(line, "#define"):
+			score["c"]++
+		case strings.HasPrefix(line, "fn ") || strings.HasPrefix(line, "let mut ") || strings.HasPrefix(line, "use ") && strings.Contains(line, "::"):
+			score["rust"]++
+		case strings.HasPrefix(line, "public class ") || strings.HasPrefix(line, "import java."):
+			score["java"]++
+		case strings.HasPrefix(line, "function ") || strings.HasPrefix(line, "const ") || strings.HasPrefix(line, "let ") || strings.Contains(line, "=> "):
+			score["javascript"]++
+		case strings.HasPrefix(strings.ToUpper(line), "SELECT ") || strings.HasPrefix(strings.ToUpper(line), "CREATE TABLE") || strings.HasPrefix(strings.ToUpper(line), "INSERT INTO"):
+			score["sql"]++
+		case strings.HasPrefix(line, "# ") || strings.HasPrefix(line, "## ") || strings.HasPrefix(line, "```"):
+			score[langMarkdown]++
+		case line == "---" || strings.HasPrefix(line, "- ") && strings.Contains(line, ": ") || isYAMLKey(line):
+			score["yaml"]++
+		}
+	}
+	best, bestScore := langPlain, 0
+	for _, lang := range languageOrder {
+		if score[lang] > bestScore {
+			best, bestScore = lang, score[lang]
+		}
+	}
+	return best
+}
+
+// isYAMLKey returns true if line looks like a YAML mapping, e.g. "name: value"
+func isYAMLKey(line string) bool {
+	i := strings.Index(line, ":")
+	if i <= 0 || (i+1 < len(line) && line[i+1] != ' ') {
+		return false
+	}
+	for _, c := range line[:i] {
+		if !isIdentChar(c) && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentChar returns true if c can be part of a keyword or identifier
+func isIdentChar(c rune) bool {
+	return c == '_' || c == '$' || c == '#' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// highlight splits text into lines of tokens for the language lang, unknown languages and langPlain return a single plain token per line
+func highlight(text, lang string) []pasteLine {
+	def, ok := languages[lang]
+	var tokens []token
+	if !ok || lang == langPlain || lang == langMarkdown || len(text) > maxHighlightLen {
+		tokens = []token{{Text: text}}
+	} else {
+		tokens = lex(text, def)
+	}
+	return splitLines(tokens)
+}
+
+// lex splits text into tokens according to def
+func lex(text string, def *langDef) []token {
+	var tokens []token
+	plain := 0 // start of the current plain text
+	emit := func(start, end int, class string) {
+		if plain < start {
+			tokens = append(tokens, token{Text: text[plain:start]})
+		}
+		tokens = append(tokens, token{Class: class, Text: text[start:end]})
+		plain = end
+	}
+	for i := 0; i < len(text); {
+		c := text[i]
+		if def.BlockComment[0] != "" && strings.HasPrefix(text[i:], def.BlockComment[0]) {
+			end := strings.Index(text[i+len(def.BlockComment[0]):], def.BlockComment[1])
+			if end < 0 {
+				end = len(text)
+			} else {
+				end += i + len(def.BlockComment[0]) + len(def.BlockComment[1])
+			}
+			emit(i, end, "com")
+			i = end
+			continue
+		}
+		if lineComment(text, i, def) {
+			end := strings.IndexByte(text[i:], '\n')
+			if end < 0 {
+				end = len(text)
+			} else {
+				end += i
+			}
+			emit(i, end, "com")
+			i = end
+			continue
+		}
+		if strings.IndexByte(def.Quotes, c) >= 0 || strings.IndexByte(def.MultilineQuotes, c) >= 0 {
+			multiline := strings.IndexByte(def.MultilineQuotes, c) >= 0
+			end := i + 1
+			for end < len(text) && text[end] != c && (multiline || text[end] != '\n') {
+				if text[end] == '\\' && !multiline {
+					end++
+				}
+				end++
+			}
+			if end < len(text) && text[end] == c {
+				end++
+			}
+			if end > len(text) {
+				end = len(text)
+			}
+			class := "str"
+			if def.Keys && followedByColon(text, end) {
+				class = "key"
+			}
+			emit(i, end, class)
+			i = end
+			continue
+		}
+		if c >= '0' && c <= '9' && (i == 0 || !isIdentChar(rune(text[i-1]))) {
+			end := i + 1
+			for end < len(text) && (isIdentChar(rune(text[end])) || text[end] == '.') {
+				end++
+			}
+			emit(i, end, "num")
+			i = end
+			continue
+		}
+		if isIdentChar(rune(c)) && (i == 0 || !isIdentChar(rune(text[i-1]))) {
+			end := i + 1
+			for end < len(text) && isIdentChar(rune(text[end])) {
+				end++
+			}
+			word := text[i:end]
+			switch {
+			case def.Keywords[word]:
+				emit(i, end, "kw")
+			case def.Keys && followedByColon(text, end):
+				emit(i, end, "key")
+			}
+			i = end
+			continue
+		}
+		i++
+	}
+	if plain < len(text) {
+		tokens = append(tokens, token{Text: text[plain:]})
+	}
+	return tokens
+}
+
+// lineComment returns true if a line comment of def starts at text[i]
+func lineComment(text string, i int, def *langDef) bool {
+	for _, prefix := range def.LineComments {
+		if strings.HasPrefix(text[i:], prefix) {
+			// # only starts a comment at the beginning of a word, e.g. not in $# or a#b
+			return prefix != "#" || i == 0 || text[i-1] == ' ' || text[i-1] == '\t' || text[i-1] == '\n'
+		}
+	}
+	return false
+}
+
+// followedByColon returns true if the next character after text[:i] that is not a space is a :
+func followedByColon(text string, i int) bool {
+	for ; i < len(text); i++ {
+		switch text[i] {
+		case ' ', '\t':
+			continue
+		case ':':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// splitLines splits tokens at new lines, tokens that span lines are split into one token per line with the same class
+func splitLines(tokens []token) []pasteLine {
+	lines := []pasteLine{{N: 1}}
+	for _, t := range tokens {
+		parts := strings.Split(t.Text, "\n")
+		for i, part := range parts {
+			if i > 0 {
+				lines = append(lines, pasteLine{N: len(lines) + 1})
+			}
+			if part != "" {
+				last := &lines[len(lines)-1]
+				last.Tokens = append(last.Tokens, token{Class: t.Class, Text: strings.TrimSuffix(part, "\r")})
+			}
+		}
+	}
+	// a final new line does not start another line
+	if len(lines) > 1 && len(lines[len(lines)-1].Tokens) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
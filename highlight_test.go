@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// linesText returns the text of every line in lines, used to compare the output of highlight without the classes
+func linesText(lines []pasteLine) []string {
+	var text []string
+	for _, l := range lines {
+		var b bytes.Buffer
+		for _, t := range l.Tokens {
+			b.WriteString(t.Text)
+		}
+		text = append(text, b.String())
+	}
+	return text
+}
+
+func TestHighlightLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		lang  string
+		lines []string
+	}{
+		{"empty", "", langPlain, []string{""}},
+		{"final new line", "a\nb\n", langPlain, []string{"a", "b"}},
+		{"empty lines are kept", "a\r\n\r\nb", langPlain, []string{"a", "", "b"}},
+		{"comment over several lines", "/* a\nb */\nx := 1\n", "go", []string{"/* a", "b */", "x := 1"}},
+		{"unknown language", "<b>\n</b>", "nope", []string{"<b>", "</b>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := highlight(tt.text, tt.lang)
+			// the line numbers are the #L anchors of the paste view and must be sequential
+			for i, l := range lines {
+				if l.N != i+1 {
+					t.Fatalf("line %d has number %d", i+1, l.N)
+				}
+			}
+			got := linesText(lines)
+			if len(got) != len(tt.lines) {
+				t.Fatalf("highlight(%q) = %q, want %q", tt.text, got, tt.lines)
+			}
+			for i := range got {
+				if got[i] != tt.lines[i] {
+					t.Fatalf("highlight(%q) = %q, want %q", tt.text, got, tt.lines)
+				}
+			}
+		})
+	}
+}
+
+func TestHighlightClasses(t *testing.T) {
+	lines := highlight("/* a\nb */", "go")
+	for _, l := range lines {
+		if len(l.Tokens) != 1 || l.Tokens[0].Class != "com" {
+			t.Errorf("line %d = %+v, want a single comment token", l.N, l.Tokens)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	// embed the time zone database so that TimeZone works without zoneinfo files on disk
+	_ "time/tzdata"
+
+	"golang.org/x/text/language"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultLanguage is used if neither Language nor Domains.<domain>.Language is set, the English messages are the keys of all catalogs
+const defaultLanguage = "en"
+
+// domainLocales contains the catalogs and language matcher of each domain, should be used as read only after initLocales() has returned
+var domainLocales map[string]*locales
+
+// locales contains the catalogs that are available for a domain
+type locales struct {
+	// tags contains the supported languages, the default language of the domain is the first element
+	tags     []language.Tag
+	matcher  language.Matcher
+	catalogs map[string]*catalog
+	location *time.Location
+}
+
+// catalog is the content of a catalog file locales/<language>.yaml, the keys of Messages are the English messages as used in the source and the templates
+type catalog struct {
+	// DateFormat is the layout used for dates, see time.Format. Defaults to dateFormat
+	DateFormat string `yaml:"DateFormat"`
+	// Days and ShortDays replace Monday and Mon in DateFormat, starting with Sunday
+	Days      []string `yaml:"Days"`
+	ShortDays []string `yaml:"ShortDays"`
+	// Months and ShortMonths replace January and Jan in DateFormat, starting with January
+	Months      []string `yaml:"Months"`
+	ShortMonths []string `yaml:"ShortMonths"`
+	// Messages maps the English messages to their translation, messages without a translation are shown in English
+	Messages map[string]string `yaml:"Messages"`
+}
+
+// localizer translates messages and dates into the language negotiated for a request, it is available to all templates as .L
+type localizer struct {
+	// Lang is the BCP 47 tag of the selected language, e.g. "sv"
+	Lang     string
+	catalog  *catalog
+	location *time.Location
+}
+
+// domainLanguage returns the default language of domain
+func domainLanguage(domain string) string {
+	if dc, ok := config.Domains[domain]; ok && dc.Language != "" {
+		return dc.Language
+	}
+	if config.Language != "" {
+		return config.Language
+	}
+	return defaultLanguage
+}
+
+// domainTimeZone returns the time zone used for dates shown for domain, an empty string means the time zone of the server
+func domainTimeZone(domain string) string {
+	if dc, ok := config.Domains[domain]; ok && dc.TimeZone != "" {
+		return dc.TimeZone
+	}
+	return config.TimeZone
+}
+
+// catalogLanguages returns the languages of all catalog files in the built-in theme, BaseDir/locales and BaseDir/<domain>/locales
+func catalogLanguages(domain string) []string {
+	found := make(map[string]bool)
+	if entries, err := fs.ReadDir(defaultAssets, "defaults/locales"); err == nil {
+		for _, entry := range entries {
+			found[strings.TrimSuffix(entry.Name(), ".yaml")] = true
+		}
+	}
+	for _, dir := range []string{filepath.Join(config.BaseDir, "locales"), filepath.Join(config.BaseDir, domain, "locales")} {
+		if entries, err := ioutil.ReadDir(dir); err == nil {
+			for _, entry := range entries {
+				if strings.HasSuffix(entry.Name(), ".yaml") {
+					found[strings.TrimSuffix(entry.Name(), ".yaml")] = true
+				}
+			}
+		}
+	}
+	var langs []string
+	for lang := range found {
+		langs = append(langs, lang)
+	}
+	return langs
+}
+
+// initLocales loads the catalogs of all domains, the catalog for a language is read with readAsset so that a domain can override a whole catalog
+func initLocales() {
+	domainLocales = make(map[string]*locales)
+	for _, domain := range config.DomainNames {
+		l := &locales{catalogs: make(map[string]*catalog), location: time.Local}
+		if tz := domainTimeZone(domain); tz != "" {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				log.Fatalln("Invalid TimeZone for", domain+":", err)
+			}
+			l.location = loc
+		}
+
+		defaultTag, err := language.Parse(domainLanguage(domain))
+		if err != nil {
+			log.Fatalln("Invalid Language for", domain+":", err)
+		}
+		l.tags = []language.Tag{defaultTag}
+		// English is always available since the messages in the source are English
+		l.catalogs[defaultLanguage] = &catalog{}
+		if defaultTag != language.English {
+			l.tags = append(l.tags, language.English)
+		}
+		for _, lang := range catalogLanguages(domain) {
+			tag, err := language.Parse(lang)
+			if err != nil {
+				log.Fatalln("Invalid catalog file name locales/"+lang+".yaml, the name must be a language tag such as sv or pt-BR:", err)
+			}
+			data, source, err := readAsset(domain, "locales/"+lang+".yaml") // defined in assets.go
+			if err != nil {
+				log.Fatalln("Unable to read "+source+":", err)
+			}
+			c := &catalog{}
+			if err := yaml.UnmarshalStrict(data, c); err != nil {
+				log.Fatalln("Unable to parse "+source+":", err)
+			}
+			l.catalogs[tag.String()] = c
+			if tag != defaultTag && tag != language.English {
+				l.tags = append(l.tags, tag)
+			}
+		}
+		if _, ok := l.catalogs[defaultTag.String()]; !ok {
+			log.Fatalln("No catalog locales/" + defaultTag.String() + ".yaml found for the Language of " + domain)
+		}
+		l.matcher = language.NewMatcher(l.tags)
+		domainLocales[domain] = l
+	}
+}
+
+// getLocalizer returns the localizer for the language that best matches the Accept-Language header of r,
+// if no supported language matches the default language of the domain is used
+func getLocalizer(r *http.Request) *localizer {
+	l, ok := domainLocales[r.Host]
+	if !ok {
+		return &localizer{Lang: defaultLanguage, catalog: &catalog{}, location: time.Local}
+	}
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, index, confidence := l.matcher.Match(tags...)
+	if confidence == language.No {
+		index = 0
+	}
+	tag := l.tags[index]
+	return &localizer{Lang: tag.String(), catalog: l.catalogs[tag.String()], location: l.location}
+}
+
+// localize translates msg into the language negotiated for r
+func localize(r *http.Request, msg string) string {
+	return getLocalizer(r).T(msg)
+}
+
+// T returns the translation of msg, if args are given the translation is used as a fmt.Sprintf format
+func (l *localizer) T(msg string, args ...interface{}) string {
+	if translated, ok := l.catalog.Messages[msg]; ok && translated != "" {
+		msg = translated
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Date formats t in the time zone of the domain with the DateFormat and the names of days and months from the catalog
+func (l *localizer) Date(t time.Time) string {
+	t = t.In(l.location)
+	layout := l.catalog.DateFormat
+	if layout == "" {
+		layout = dateFormat
+	}
+	names := []struct {
+		token string
+		names []string
+		index int
+	}{
+		{"Monday", l.catalog.Days, int(t.Weekday())},
+		{"Mon", l.catalog.ShortDays, int(t.Weekday())},
+		{"January", l.catalog.Months, int(t.Month()) - 1},
+		{"Jan", l.catalog.ShortMonths, int(t.Month()) - 1},
+	}
+	// the layout is split at the day and month names so that translated names are never interpreted as part of the layout
+	var b strings.Builder
+	for layout != "" {
+		next, nextToken := -1, 0
+		for i, n := range names {
+			if j := strings.Index(layout, n.token); j >= 0 && (next < 0 || j < next) {
+				next, nextToken = j, i
+			}
+		}
+		if next < 0 {
+			b.WriteString(t.Format(layout))
+			break
+		}
+		n := names[nextToken]
+		b.WriteString(t.Format(layout[:next]))
+		if n.index < len(n.names) {
+			b.WriteString(n.names[n.index])
+		} else {
+			b.WriteString(t.Format(n.token))
+		}
+		layout = layout[next+len(n.token):]
+	}
+	return b.String()
+}
@@ -3,16 +3,83 @@ package main
 import (
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
-// getAuroCertTLSConf is used if NoTLS is set to false.
-// Note that a CertDir must be specified in the config if NoTLS is set to false
-func getServer(mux *http.ServeMux) (server *http.Server) {
+const (
+	// letsEncryptStagingURL is the Directory endpoint of the Let's Encrypt staging environment
+	letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	// certStatusInterval specifies how often the ACME certificates are checked for the certificate status admin view
+	certStatusInterval = time.Hour
+	// certExpiryWarning is the remaining validity that is reported as an error, autocert renews certificates 30 days before they expire
+	certExpiryWarning = 14 * 24 * time.Hour
+)
+
+// tlsProfile contains the TLS settings for one of the named profiles that can be selected with TLSProfile
+type tlsProfile struct {
+	MinVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+}
+
+// tlsProfiles is based on the Mozilla server side TLS recommendations, note that the cipher suites for TLS 1.3 are not configurable in crypto/tls
+var tlsProfiles = map[string]tlsProfile{
+	// modern only supports TLS 1.3
+	"modern": {
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	// intermediate supports TLS 1.2 with forward secret AEAD cipher suites and TLS 1.3
+	"intermediate": {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+}
+
+// certStatus contains the state of the certificate for a single host
+type certStatus struct {
+	Source        string
+	NotAfter      time.Time
+	LastRenewal   time.Time
+	LastError     string
+	LastErrorTime time.Time
+}
+
+var (
+	// certStatuses maps host names to the status of their certificate, only access certStatuses while holding certStatusMutex
+	certStatuses    = make(map[string]*certStatus)
+	certStatusMutex sync.Mutex
+)
+
+// getServer is used if NoTLS is set to false and returns the HTTPS server together with the handler for the plain HTTP redirect listeners.
+// Domains covered by config.Certificates use the static certificates and all other domains use Let's Encrypt,
+// note that a CertDir must be specified in the config if any domain uses Let's Encrypt
+func getServer(mux *http.ServeMux) (server *http.Server, httpHandler http.Handler) {
 	var certdir string
 	if config.CertDir != "" {
 		certdir = config.CertDir
@@ -20,35 +87,349 @@ func getServer(mux *http.ServeMux) (server *http.Server) {
 		certdir = config.BaseDir
 	}
 
-	m := autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		Cache:      autocert.DirCache(certdir),
-		HostPolicy: autocert.HostWhitelist(config.DomainNames...),
-		Email:      config.Email,
+	staticCerts, err := loadStaticCertificates() // defined in certs.go
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// only use ACME for the domains that are not covered by a static certificate
+	var acmeHosts []string
+	acmeHostSet := make(map[string]bool)
+	for _, domain := range config.DomainNames {
+		host := hostWithoutPort(domain)
+		if !staticCerts.covers(host) {
+			acmeHosts = append(acmeHosts, host)
+			acmeHostSet[strings.ToLower(host)] = true
+		}
+	}
+
+	var m *autocert.Manager
+	if len(acmeHosts) > 0 {
+		client, err := getACMEClient()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		eab, err := getExternalAccountBinding()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		// certs from other CAs than Let's Encrypt production are cached in a separate directory so that they are never mixed up
+		if client.DirectoryURL != acme.LetsEncryptURL {
+			certdir = filepath.Join(certdir, "acme-"+cacheDirName(client.DirectoryURL))
+		}
+		m = &autocert.Manager{
+			Prompt:                 autocert.AcceptTOS,
+			Cache:                  autocert.DirCache(certdir),
+			HostPolicy:             autocert.HostWhitelist(acmeHosts...),
+			Email:                  config.Email,
+			Client:                 client,
+			ExternalAccountBinding: eab,
+		}
+		go certStatusRoutine(m, acmeHosts)
+	}
+
+	getCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert := staticCerts.getCertificate(hello); cert != nil {
+			return cert, nil
+		}
+		if m != nil {
+			cert, err := m.GetCertificate(hello)
+			// only track the configured hosts so that scanners sending random SNI values can not grow certStatuses
+			if acmeHostSet[strings.ToLower(hello.ServerName)] {
+				if err != nil {
+					recordCertificateError(hello.ServerName, "acme", err)
+				} else {
+					recordCertificate(hello.ServerName, "acme", cert)
+				}
+			}
+			return cert, err
+		}
+		return nil, errors.New("no certificate configured for " + hello.ServerName)
+	}
+
+	profile, ok := tlsProfiles[config.TLSProfile]
+	if !ok {
+		log.Fatalln("Unknown TLSProfile " + config.TLSProfile + ", valid profiles are modern and intermediate")
+	}
+	nextProtos := []string{"h2", "http/1.1", acme.ALPNProto}
+	if config.DisableHTTP2 {
+		nextProtos = []string{"http/1.1", acme.ALPNProto}
 	}
 	tlsConf := &tls.Config{
-		Rand:                     rand.Reader,
-		Time:                     time.Now,
-		NextProtos:               []string{acme.ALPNProto, "http/1.1"}, // add http2.NextProtoTLS?
-		MinVersion:               tls.VersionTLS12,
-		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		GetCertificate:           m.GetCertificate,
-		PreferServerCipherSuites: true,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-		},
+		Rand:             rand.Reader,
+		Time:             time.Now,
+		NextProtos:       nextProtos,
+		MinVersion:       profile.MinVersion,
+		CurvePreferences: profile.CurvePreferences,
+		CipherSuites:     profile.CipherSuites,
+		GetCertificate:   getCertificate,
 	}
 	server = &http.Server{
 		Addr:      config.TLSAddressPort,
 		Handler:   mux,
 		TLSConfig: tlsConf,
-		// https://blog.bracebin.com/achieving-perfect-ssl-labs-score-with-go
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
-	// Handle ACME "http-01" challenge responses on external port 80.
-	go http.ListenAndServe(config.AddressPort, m.HTTPHandler(nil))
+	if config.DisableHTTP2 {
+		// a non nil empty TLSNextProto map disables the automatic HTTP/2 support in net/http
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	httpHandler = http.HandlerFunc(redirectToHTTPS)
+	if config.NoHTTPRedirect {
+		httpHandler = http.NotFoundHandler()
+	}
+	if m != nil {
+		// Handle ACME "http-01" challenge responses on external port 80 and pass all other requests to httpHandler.
+		httpHandler = m.HTTPHandler(httpHandler)
+	}
 	return
 }
+
+// redirectToHTTPS redirects requests for any of the configured DomainNames to the same path and query using https.
+// The query is kept as is so that quick add requests such as example.com?https://example.org still work after the redirect.
+// The redirect target uses the host of the matching entry in DomainNames together with the port of the TLS listener, the entry can
+// contain the port of the plain HTTP listener
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(hostWithoutPort(r.Host))
+	target := ""
+	for _, domain := range config.DomainNames {
+		if strings.ToLower(hostWithoutPort(domain)) == host {
+			target = hostWithoutPort(domain)
+			break
+		}
+	}
+	if target == "" {
+		logErrors(w, r, errServerError, http.StatusBadRequest, "Refusing to redirect request for unknown host")
+		return
+	}
+	if port := httpsPort(); port != "" {
+		target = net.JoinHostPort(target, port)
+	} else if strings.Contains(target, ":") {
+		// IPv6 literal
+		target = "[" + target + "]"
+	}
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// 308 keeps the method and body of e.g. POST requests
+		status = http.StatusPermanentRedirect
+	}
+	logOK(r, status)
+	http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), status)
+}
+
+// httpsPort returns the port of the first TLS listener, an empty string means the default port 443. TLS listeners on unix sockets or
+// systemd sockets are assumed to be reached on port 443 through a proxy or the socket unit
+func httpsPort() string {
+	for _, lc := range getListenerConfigs() { // defined in listeners.go
+		if lc.Serve != "https" {
+			continue
+		}
+		switch lc.Network {
+		case "", "tcp", "tcp4", "tcp6":
+			if _, port, err := net.SplitHostPort(lc.Address); err == nil && port != "443" {
+				return port
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// checkHSTSPreload returns warnings for every HSTS preload requirement that the configuration does not meet, see https://hstspreload.org
+func checkHSTSPreload() (warnings []string) {
+	if config.HSTS == "" {
+		return nil
+	}
+	// HSTS together with NoTLS is rejected by validateConfig
+	if config.NoTLS {
+		return nil
+	}
+	var maxAge int64 = -1
+	var includeSubDomains, preload bool
+	for _, directive := range strings.Split(config.HSTS, ";") {
+		directive = strings.TrimSpace(directive)
+		name := strings.ToLower(directive)
+		value := ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name = strings.ToLower(strings.TrimSpace(directive[:i]))
+			value = strings.Trim(strings.TrimSpace(directive[i+1:]), "\"")
+		}
+		switch name {
+		case "max-age":
+			if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+				maxAge = v
+			}
+		case "includesubdomains":
+			includeSubDomains = true
+		case "preload":
+			preload = true
+		}
+	}
+	if maxAge < 0 {
+		warnings = append(warnings, "HSTS is missing a valid max-age directive")
+	} else if maxAge < 31536000 {
+		warnings = append(warnings, "HSTS max-age is "+strconv.FormatInt(maxAge, 10)+", preloading requires at least 31536000 (1 year)")
+	}
+	if !includeSubDomains {
+		warnings = append(warnings, "HSTS is missing the includeSubDomains directive required for preloading")
+	}
+	if !preload {
+		warnings = append(warnings, "HSTS is missing the preload directive required for preloading")
+	}
+	if config.NoHTTPRedirect {
+		warnings = append(warnings, "NoHTTPRedirect is set, preloading requires that HTTP requests are redirected to HTTPS on the same host")
+	}
+	return warnings
+}
+
+// getACMEClient returns the ACME client for the configured directory, ACMEDirectoryURL takes precedence over ACMEStaging
+func getACMEClient() (*acme.Client, error) {
+	client := &acme.Client{DirectoryURL: acme.LetsEncryptURL}
+	if config.ACMEStaging {
+		client.DirectoryURL = letsEncryptStagingURL
+	}
+	if config.ACMEDirectoryURL != "" {
+		client.DirectoryURL = config.ACMEDirectoryURL
+	}
+	// private CAs such as step-ca or pebble usually serve the directory with a certificate signed by their own root
+	if config.ACMERootCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ACMERootCAFile)
+		if err != nil {
+			return nil, errors.New("unable to read ACMERootCAFile: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid PEM certificates found in ACMERootCAFile " + config.ACMERootCAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	return client, nil
+}
+
+// getExternalAccountBinding returns the EAB credentials if ACMEEABKeyID is set, the HMAC key is base64url encoded as provided by the CA
+func getExternalAccountBinding() (*acme.ExternalAccountBinding, error) {
+	if config.ACMEEABKeyID == "" {
+		return nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(config.ACMEEABHMACKey, "="))
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("ACMEEABHMACKey must be a base64url encoded key")
+	}
+	return &acme.ExternalAccountBinding{KID: config.ACMEEABKeyID, Key: key}, nil
+}
+
+// cacheDirName returns a directory name for the host and path of an ACME directory URL
+func cacheDirName(directoryURL string) string {
+	u, err := url.Parse(directoryURL)
+	if err != nil {
+		return "custom"
+	}
+	return strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, u.Host+u.Path), "_")
+}
+
+// certStatusRoutine periodically requests the certificate for all ACME hosts from m so that missing certificates are issued,
+// renewals are noticed and certificates that autocert has failed to renew in the background are reported in the certificate status view
+func certStatusRoutine(m *autocert.Manager, hosts []string) {
+	// issuing a certificate before the listeners answer the HTTP-01 and TLS-ALPN-01 challenges would fail and count against the
+	// failed validation limit of the CA
+	<-serving
+	for {
+		for _, host := range hosts {
+			// pretend to be a client that supports ECDSA so that autocert does not issue an extra RSA certificate
+			hello := &tls.ClientHelloInfo{ServerName: host, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+			cert, err := m.GetCertificate(hello)
+			if err != nil {
+				recordCertificateError(host, "acme", err)
+				continue
+			}
+			recordCertificate(host, "acme", cert)
+			if cert.Leaf != nil && time.Until(cert.Leaf.NotAfter) < certExpiryWarning {
+				recordCertificateError(host, "acme", errors.New("certificate has not been renewed and expires "+cert.Leaf.NotAfter.UTC().Format(dateFormat)))
+			}
+		}
+		time.Sleep(certStatusInterval)
+	}
+}
+
+// recordCertificate updates the status for host with cert, a changed expiry date is recorded as a renewal
+func recordCertificate(host, source string, cert *tls.Certificate) {
+	if cert == nil || cert.Leaf == nil || host == "" {
+		return
+	}
+	certStatusMutex.Lock()
+	defer certStatusMutex.Unlock()
+	status, ok := certStatuses[host]
+	if !ok {
+		status = &certStatus{}
+		certStatuses[host] = status
+	}
+	status.Source = source
+	if !status.NotAfter.Equal(cert.Leaf.NotAfter) {
+		status.NotAfter = cert.Leaf.NotAfter
+		status.LastRenewal = time.Now()
+	}
+}
+
+// recordCertificateError stores the last error that occurred while getting or renewing the certificate for host
+func recordCertificateError(host, source string, err error) {
+	if err == nil || host == "" {
+		return
+	}
+	if logger != nil {
+		logger.Println("Certificate error for", url.QueryEscape(host), err)
+	}
+	certStatusMutex.Lock()
+	defer certStatusMutex.Unlock()
+	status, ok := certStatuses[host]
+	if !ok {
+		status = &certStatus{Source: source}
+		certStatuses[host] = status
+	}
+	status.LastError = err.Error()
+	status.LastErrorTime = time.Now()
+}
+
+// listCertStatus is an admin view of the expiry date and last renewal error of the certificate for each host
+func listCertStatus(w http.ResponseWriter, r *http.Request) {
+	name, ok := authorizeAdmin(r.URL.RawQuery, roleCerts) // defined in credentials.go
+	if !ok {
+		http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
+		return
+	}
+	if logger != nil {
+		logger.Println("Certificate status listed by", name)
+	}
+	certStatusMutex.Lock()
+	hosts := make([]string, 0, len(certStatuses))
+	for host := range certStatuses {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	resp := ""
+	for _, host := range hosts {
+		status := certStatuses[host]
+		resp += "Host: " + host + " Source: " + status.Source
+		if !status.NotAfter.IsZero() {
+			resp += " Expires: " + status.NotAfter.UTC().Format(dateFormat) + fmt.Sprintf(" (%d days)", int(time.Until(status.NotAfter).Hours()/24))
+			resp += " LastRenewal: " + status.LastRenewal.UTC().Format(dateFormat)
+		}
+		if status.LastError != "" {
+			resp += " LastError: " + status.LastErrorTime.UTC().Format(dateFormat) + " " + status.LastError
+		}
+		resp += "\n"
+	}
+	certStatusMutex.Unlock()
+	if resp == "" {
+		resp = "No certificates loaded\n"
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, resp)
+	logOK(r, http.StatusOK)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by systemd socket activation
+	listenFDsStart = 3
+	// shutdownTimeout is the maximum time active requests are given to finish after receiving SIGTERM or SIGINT
+	shutdownTimeout = 30 * time.Second
+)
+
+// shorterListener is an open listener together with the type of server that should serve it
+type shorterListener struct {
+	net.Listener
+	Serve string
+}
+
+// serving is closed once a server has been started for every listener, routines that need the listeners to answer, e.g. the
+// certificate status routine whose ACME challenges are answered by the listeners, wait for it
+var serving = make(chan struct{})
+
+// systemdListeners contains the sockets passed by systemd, only access systemdListeners while holding systemdMutex
+var (
+	systemdListeners []systemdListener
+	systemdMutex     sync.Mutex
+)
+
+// systemdListener is a socket passed by systemd together with its name from LISTEN_FDNAMES
+type systemdListener struct {
+	name     string
+	listener net.Listener
+	used     bool
+}
+
+// getListenerConfigs returns config.Listeners or if no Listeners are configured the listeners specified by AddressPort and TLSAddressPort
+func getListenerConfigs() []ListenerConfig {
+	if len(config.Listeners) > 0 {
+		return config.Listeners
+	}
+	if config.NoTLS {
+		return []ListenerConfig{{Network: "tcp", Address: config.AddressPort, Serve: "http"}}
+	}
+	return []ListenerConfig{
+		{Network: "tcp", Address: config.AddressPort, Serve: "redirect"},
+		{Network: "tcp", Address: config.TLSAddressPort, Serve: "https"},
+	}
+}
+
+// openListeners opens all configured listeners, note that the sockets are opened before any server is started so that a configuration error fails early
+func openListeners() ([]shorterListener, error) {
+	var listeners []shorterListener
+	for _, lc := range getListenerConfigs() {
+		serve := lc.Serve
+		if serve == "" {
+			serve = "http"
+		}
+		if serve != "http" && serve != "https" && serve != "redirect" {
+			return nil, errors.New("invalid Serve value " + lc.Serve + " for listener " + lc.Address + ", valid values are http, https and redirect")
+		}
+		if serve != "http" && config.NoTLS {
+			return nil, errors.New("listener " + lc.Address + " uses Serve: " + serve + " which requires NoTLS to be false")
+		}
+		l, err := openListener(lc)
+		if err != nil {
+			return nil, err
+		}
+		if logger != nil {
+			logger.Println("Listening on", lc.Network, l.Addr().String(), "serving", serve)
+		}
+		listeners = append(listeners, shorterListener{Listener: wrapProxyProtocol(l), Serve: serve}) // wrapProxyProtocol is defined in proxy.go
+	}
+	return listeners, nil
+}
+
+// openListener opens a single listener
+func openListener(lc ListenerConfig) (net.Listener, error) {
+	switch lc.Network {
+	case "", "tcp", "tcp4", "tcp6":
+		network := lc.Network
+		if network == "" {
+			network = "tcp"
+		}
+		return net.Listen(network, lc.Address)
+	case "unix":
+		return listenUnix(lc)
+	case "systemd":
+		return getSystemdListener(lc.Address)
+	}
+	return nil, errors.New("invalid Network " + lc.Network + " for listener " + lc.Address + ", valid values are tcp, tcp4, tcp6, unix and systemd")
+}
+
+// listenUnix creates a unix socket with the configured permissions, a stale socket left by a previous process is removed first
+func listenUnix(lc ListenerConfig) (net.Listener, error) {
+	if info, err := os.Lstat(lc.Address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("refusing to replace " + lc.Address + " with a unix socket since it is not a socket")
+		}
+		if err := os.Remove(lc.Address); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", lc.Address)
+	if err != nil {
+		return nil, err
+	}
+	if lc.SocketMode != "" {
+		mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, errors.New("invalid SocketMode " + lc.SocketMode + " for " + lc.Address + ", use octal notation e.g. 0660")
+		}
+		if err := os.Chmod(lc.Address, os.FileMode(mode)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if lc.SocketGroup != "" {
+		gid, err := strconv.Atoi(lc.SocketGroup)
+		if err != nil {
+			group, err := user.LookupGroup(lc.SocketGroup)
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			gid, _ = strconv.Atoi(group.Gid)
+		}
+		if err := os.Chown(lc.Address, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// getSystemdListener returns a socket passed by systemd socket activation. If name is set the socket with the matching FileDescriptorName is used,
+// otherwise the first socket that has not been used by another listener is returned
+func getSystemdListener(name string) (net.Listener, error) {
+	systemdMutex.Lock()
+	defer systemdMutex.Unlock()
+	if systemdListeners == nil {
+		if err := loadSystemdListeners(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range systemdListeners {
+		sl := &systemdListeners[i]
+		if sl.used || (name != "" && sl.name != name) {
+			continue
+		}
+		sl.used = true
+		return sl.listener, nil
+	}
+	if name != "" {
+		return nil, errors.New("no unused socket named " + name + " was passed by systemd")
+	}
+	return nil, errors.New("no unused socket was passed by systemd")
+}
+
+// loadSystemdListeners reads the sockets passed with LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, see sd_listen_fds(3).
+// The variables are unset afterwards so that they are not inherited by child processes
+func loadSystemdListeners() error {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return errors.New("a systemd listener is configured but no sockets were passed by systemd")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return errors.New("a systemd listener is configured but no sockets were passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	systemdListeners = make([]systemdListener, 0, nfds)
+	for fd := listenFDsStart; fd < listenFDsStart+nfds; fd++ {
+		name := ""
+		if fd-listenFDsStart < len(names) {
+			name = names[fd-listenFDsStart]
+		}
+		// net.FileListener duplicates the descriptor so the original can be closed right away
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return errors.New("systemd socket " + strconv.Itoa(fd) + " " + name + " is not a stream socket: " + err.Error())
+		}
+		systemdListeners = append(systemdListeners, systemdListener{name: name, listener: l})
+	}
+	return nil
+}
+
+// serve starts a server for each listener and blocks until the process receives SIGTERM or SIGINT or a listener fails.
+// On a signal the servers stop accepting new connections, active requests are given shutdownTimeout to finish and all links are saved to disk,
+// together with socket activation this allows shorter to be restarted without refusing any connections.
+func serve(mux *http.ServeMux, listeners []shorterListener) {
+	var handler http.Handler = mux
+	if config.H2C && !config.DisableHTTP2 {
+		// HTTP/2 without TLS for running behind a TLS terminating proxy that speaks HTTP/2 to its backends
+		handler = h2c.NewHandler(mux, &http2.Server{})
+	}
+	servers := map[string]*http.Server{"http": {Handler: handler}}
+	for _, l := range listeners {
+		if l.Serve != "http" && servers["https"] == nil {
+			tlsServer, redirectHandler := getServer(mux) // defined in letsencrypt.go
+			servers["https"] = tlsServer
+			// the health endpoints are also served on the redirect listeners since health checks usually do not follow redirects
+			redirectMux := http.NewServeMux()
+			handleHealth(redirectMux) // defined in health.go
+			redirectMux.Handle("/", redirectHandler)
+			servers["redirect"] = &http.Server{Handler: redirectMux}
+		}
+	}
+
+	for _, server := range servers {
+		server.ConnContext = proxyConnContext // defined in proxy.go
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l shorterListener) {
+			var err error
+			if l.Serve == "https" {
+				err = servers[l.Serve].ServeTLS(l, "", "")
+			} else {
+				err = servers[l.Serve].Serve(l)
+			}
+			errs <- err
+		}(l)
+	}
+	close(serving)
+	setReady(&readiness.serving) // defined in health.go
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		log.Fatalln(err)
+	case sig := <-signals:
+		setNotReady(&readiness.serving)
+		if logger != nil {
+			logger.Println("Received", sig, "shutting down")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil && logger != nil {
+				logger.Println("Error while shutting down server:", err)
+			}
+		}(server)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stopNetcat(ctx) // defined in netcat.go
+	}()
+	wg.Wait()
+	saveAllBackups() // defined in db.go
+}
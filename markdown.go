@@ -0,0 +1,257 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxMarkdownDepth limits nested block quotes so that a text can not make the renderer recurse without bounds
+	maxMarkdownDepth = 8
+	// maxInlineSpan is the longest code span, emphasis or link, the end of an inline element is only searched this far so that
+	// many unmatched markers can not make rendering quadratic
+	maxInlineSpan = 2048
+)
+
+// renderMarkdown renders the common subset of Markdown as HTML: headings, paragraphs, lists, block quotes, code blocks, rules, emphasis,
+// code spans and links. The output is sanitized by construction, all text is escaped, raw HTML in the text is shown as text and links are
+// only created for http, https and mailto urls and anchors on the same page
+func renderMarkdown(text string) template.HTML {
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), 0)
+	return template.HTML(b.String())
+}
+
+// renderBlocks renders the block level elements in lines
+func renderBlocks(b *strings.Builder, lines []string, depth int) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			b.WriteString("<p>" + renderInline(strings.Join(paragraph, " ")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			lang := strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>")
+			for n, l := range highlight(strings.Join(code, "\n"), lang) { // defined in highlight.go
+				if n > 0 {
+					b.WriteString("\n")
+				}
+				for _, t := range l.Tokens {
+					if t.Class != "" {
+						b.WriteString(`<span class="` + t.Class + `">` + html.EscapeString(t.Text) + "</span>")
+					} else {
+						b.WriteString(html.EscapeString(t.Text))
+					}
+				}
+			}
+			b.WriteString("</code></pre>\n")
+		case headingLevel(trimmed) > 0:
+			flush()
+			level := strconv.Itoa(headingLevel(trimmed))
+			b.WriteString("<h" + level + ">" + renderInline(strings.TrimSpace(strings.TrimLeft(trimmed, "#"))) + "</h" + level + ">\n")
+		case isRule(trimmed):
+			flush()
+			b.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			if depth < maxMarkdownDepth {
+				renderBlocks(b, quote, depth+1)
+			} else {
+				b.WriteString("<p>" + renderInline(strings.Join(quote, " ")) + "</p>\n")
+			}
+			b.WriteString("</blockquote>\n")
+		case listItem(trimmed) != "":
+			flush()
+			tag := listItem(trimmed)
+			b.WriteString("<" + tag + ">\n")
+			for ; i < len(lines) && listItem(strings.TrimSpace(lines[i])) == tag; i++ {
+				item := strings.TrimSpace(lines[i])
+				item = item[strings.IndexByte(item, ' ')+1:]
+				// indented lines continue the item
+				for i+1 < len(lines) && strings.HasPrefix(lines[i+1], "  ") && listItem(strings.TrimSpace(lines[i+1])) == "" && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+					item += " " + strings.TrimSpace(lines[i])
+				}
+				b.WriteString("<li>" + renderInline(item) + "</li>\n")
+			}
+			i--
+			b.WriteString("</" + tag + ">\n")
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flush()
+}
+
+// headingLevel returns the level of the heading line or 0 if line is not a heading
+func headingLevel(line string) int {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0
+	}
+	return level
+}
+
+// isRule returns true if line is a horizontal rule, e.g. --- or ***
+func isRule(line string) bool {
+	if len(line) < 3 {
+		return false
+	}
+	for _, c := range line {
+		if c != rune(line[0]) {
+			return false
+		}
+	}
+	return line[0] == '-' || line[0] == '*' || line[0] == '_'
+}
+
+// listItem returns "ul" or "ol" if line starts a list item, otherwise an empty string
+func listItem(line string) string {
+	if len(line) >= 2 && (line[0] == '-' || line[0] == '*' || line[0] == '+') && line[1] == ' ' {
+		return "ul"
+	}
+	i := 0
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	if i > 0 && i+1 < len(line) && line[i] == '.' && line[i+1] == ' ' {
+		return "ol"
+	}
+	return ""
+}
+
+// inlineWindow returns s cut to maxInlineSpan bytes
+func inlineWindow(s string) string {
+	if len(s) > maxInlineSpan {
+		return s[:maxInlineSpan]
+	}
+	return s
+}
+
+// renderInline renders code spans, emphasis and links in s and escapes everything else
+func renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			if end := strings.IndexByte(inlineWindow(s[i+1:]), '`'); end >= 0 {
+				b.WriteString("<code>" + html.EscapeString(s[i+1:i+1+end]) + "</code>")
+				i += end + 2
+				continue
+			}
+		case c == '_' && i > 0 && isIdentChar(rune(s[i-1])):
+			// underscores inside words, e.g. snake_case, are not emphasis
+		case strings.HasPrefix(s[i:], "**") || strings.HasPrefix(s[i:], "__"):
+			if end := closingMarker(inlineWindow(s[i+2:]), c, 2); end > 0 {
+				b.WriteString("<strong>" + renderInline(s[i+2:i+2+end]) + "</strong>")
+				i += end + 4
+				continue
+			}
+		case c == '*' || c == '_':
+			if end := closingMarker(inlineWindow(s[i+1:]), c, 1); end > 0 {
+				b.WriteString("<em>" + renderInline(s[i+1:i+1+end]) + "</em>")
+				i += end + 2
+				continue
+			}
+		case c == '[':
+			if text, target, n := parseLink(inlineWindow(s[i:])); n > 0 {
+				if safeLinkTarget(target) {
+					b.WriteString(`<a href="` + html.EscapeString(target) + `" rel="nofollow noopener noreferrer">` + renderInline(text) + "</a>")
+				} else {
+					b.WriteString(renderInline(text))
+				}
+				i += n
+				continue
+			}
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// closingMarker returns the index in s of the n markers c that close an emphasis, or -1 if there are none. Runs of markers with another
+// length are nested emphasis and skipped, e.g. the ** in *a **b** c*, the last markers of a run of three close the emphasis, e.g. ***x***
+func closingMarker(s string, c byte, n int) int {
+	for j := 0; j < len(s); j++ {
+		if s[j] == '\\' {
+			j++
+			continue
+		}
+		if s[j] != c {
+			continue
+		}
+		run := 1
+		for j+run < len(s) && s[j+run] == c {
+			run++
+		}
+		switch {
+		case run == n:
+			return j
+		case run == 3:
+			return j + 3 - n
+		}
+		j += run - 1
+	}
+	return -1
+}
+
+// parseLink parses a link of the form [text](target) at the beginning of s, n is the length of the link or 0 if s does not start with a link
+func parseLink(s string) (text, target string, n int) {
+	closeText := strings.Index(s, "](")
+	if closeText < 0 {
+		return "", "", 0
+	}
+	closeTarget := strings.IndexByte(s[closeText+2:], ')')
+	if closeTarget < 0 {
+		return "", "", 0
+	}
+	return s[1:closeText], strings.TrimSpace(s[closeText+2 : closeText+2+closeTarget]), closeText + 3 + closeTarget
+}
+
+// safeLinkTarget returns true if target is an http, https or mailto url or an anchor on the same page, e.g. #L3 for a line of the paste
+// view, all other schemes, e.g. javascript:, are dropped
+func safeLinkTarget(target string) bool {
+	if strings.HasPrefix(target, "#") {
+		return true
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"javascript link", "[x](javascript:alert(1))", "<p>x)</p>\n"},
+		{"javascript link with upper case scheme", "[x](JavaScript:alert(1))", "<p>x)</p>\n"},
+		{"data link", "[x](data:text/html,<script>alert(1)</script>)", "<p>x&lt;/script&gt;)</p>\n"},
+		{"quote injection", `[x](https://a.example/"onmouseover="alert(1))`, `<p><a href="https://a.example/&#34;onmouseover=&#34;alert(1" rel="nofollow noopener noreferrer">x</a>)</p>` + "\n"},
+		{"single quote injection", "[x](https://a.example/?q=<b>&r='1')", `<p><a href="https://a.example/?q=&lt;b&gt;&amp;r=&#39;1&#39;" rel="nofollow noopener noreferrer">x</a></p>` + "\n"},
+		{"link text is rendered", "[**b**](https://e.example)", `<p><a href="https://e.example" rel="nofollow noopener noreferrer"><strong>b</strong></a></p>` + "\n"},
+		{"line anchor", "[see](#L3)", `<p><a href="#L3" rel="nofollow noopener noreferrer">see</a></p>` + "\n"},
+		{"quote injection in anchor", `[x](#"onclick="alert(1))`, `<p><a href="#&#34;onclick=&#34;alert(1" rel="nofollow noopener noreferrer">x</a>)</p>` + "\n"},
+		{"raw script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"raw html attribute", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"raw html in heading", "# h <i>", "<h1>h &lt;i&gt;</h1>\n"},
+		{"raw html in code span", "`<b>`", "<p><code>&lt;b&gt;</code></p>\n"},
+		{"raw html in code block", "```\n</code></pre><b>\n```", "<pre><code>&lt;/code&gt;&lt;/pre&gt;&lt;b&gt;</code></pre>\n"},
+		{"em in strong", "**bold *em* bold**", "<p><strong>bold <em>em</em> bold</strong></p>\n"},
+		{"strong in em", "*a **b** c*", "<p><em>a <strong>b</strong> c</em></p>\n"},
+		{"strong and em", "***x***", "<p><strong><em>x</em></strong></p>\n"},
+		{"unclosed strong", "**a", "<p>**a</p>\n"},
+		{"escaped markers", `a\*b\*`, "<p>a*b*</p>\n"},
+		{"underscores in words", "snake_case_name", "<p>snake_case_name</p>\n"},
+		{"nested block quotes", "> q\n> > qq", "<blockquote>\n<p>q</p>\n<blockquote>\n<p>qq</p>\n</blockquote>\n</blockquote>\n"},
+		{"highlighted code block", "```go\nfunc main() {}\n```", `<pre><code><span class="kw">func</span> main() {}</code></pre>` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(renderMarkdown(tt.input)); got != tt.want {
+				t.Errorf("renderMarkdown(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSafeLinkTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com/a?b=c#d", true},
+		{"mailto:a@example.com", true},
+		{"#L12", true},
+		{"javascript:alert(1)", false},
+		{"JAVASCRIPT:alert(1)", false},
+		{"vbscript:msgbox(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"//example.com", false},
+		{"/relative", false},
+		{"%zz", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := safeLinkTarget(tt.target); got != tt.want {
+			t.Errorf("safeLinkTarget(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
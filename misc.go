@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
-	"go/build"
 	"html/template"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -43,14 +44,24 @@ func initLinkLens() {
 	for _, domain := range config.DomainNames {
 		domainLinkLens[domain] = new(LinkLens)
 		initLinkLensDomain(domain)
-		// Start TimeoutManager for all key lengths. Defined in types.go
-		go domainLinkLens[domain].LinkLen1.TimeoutManager()
-		go domainLinkLens[domain].LinkLen2.TimeoutManager()
-		go domainLinkLens[domain].LinkLen3.TimeoutManager()
-		go domainLinkLens[domain].LinkCustom.TimeoutManager()
 	}
 }
 
+// startTimeoutManagers starts a TimeoutManager for all key lengths on all domains and blocks until all of them are running.
+// Call startTimeoutManagers after setupDB so that the restored links are not modified while they are being restored
+func startTimeoutManagers() {
+	var started sync.WaitGroup
+	for _, domain := range config.DomainNames {
+		started.Add(4)
+		// Defined in types.go
+		go domainLinkLens[domain].LinkLen1.TimeoutManager(&started)
+		go domainLinkLens[domain].LinkLen2.TimeoutManager(&started)
+		go domainLinkLens[domain].LinkLen3.TimeoutManager(&started)
+		go domainLinkLens[domain].LinkCustom.TimeoutManager(&started)
+	}
+	started.Wait()
+}
+
 func initLinkLensDomain(domain string) {
 	domainLinkLens[domain].LinkLen1 = LinkLen{
 		Mutex:   sync.RWMutex{},
@@ -114,6 +125,9 @@ func addHeaders(w http.ResponseWriter, r *http.Request) {
 	if config.CSP != "" {
 		w.Header().Add("Content-Security-Policy", strings.ReplaceAll(config.CSP, "###DomainNames###", r.Host))
 	}
+	// pages and messages are negotiated with Accept-Language, defined in i18n.go
+	w.Header().Set("Content-Language", getLocalizer(r).Lang)
+	w.Header().Add("Vary", "Accept-Language")
 }
 
 // validRequest returns true if the host string matches any of the valid hosts specified in the config and if the request is of a valid method (GET, POST)
@@ -147,27 +161,11 @@ func lowRAM() bool {
 	return m.Sys > config.MaxRAM
 }
 
+// findFolderDefaultLocations returns the path to folder if it exists in the current directory, otherwise an empty string is returned
 func findFolderDefaultLocations(folder string) (path string) {
 	if _, err := os.Stat(filepath.Join(".", folder)); !os.IsNotExist(err) {
 		return filepath.Join(".", folder)
 	}
-	possibleDirs := os.Getenv("GOPATH")
-	if possibleDirs == "" {
-		possibleDirs = build.Default.GOPATH
-	}
-	var dirs []string
-	if runtime.GOOS == "windows" {
-		dirs = strings.Split(possibleDirs, ";")
-	} else {
-		dirs = strings.Split(possibleDirs, ":")
-	}
-	for _, dir := range dirs {
-		if _, err := os.Stat(filepath.Join(dir, "src", "github.com", "7i", "shorter", folder)); !os.IsNotExist(err) {
-			// Found
-			return filepath.Join(dir, "src", "github.com", "7i", "shorter", folder)
-		}
-	}
-
 	return ""
 }
 
@@ -204,8 +202,7 @@ func returnDecompressed(lnk *Link, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	dataReader, err := gzip.NewReader(strings.NewReader(lnk.Data))
-	if err == nil {
-		fmt.Println("ERROR in lnk.Data, misc.go line 203", lnk.Data) // DEBUG
+	if err != nil {
 		logErrors(w, r, errServerError, http.StatusInternalServerError, "Error: invalid lnk.Data in request to returnDecompressed().")
 		return
 	}
@@ -220,25 +217,26 @@ func returnDecompressed(lnk *Link, w http.ResponseWriter, r *http.Request) {
 	logOK(r, http.StatusOK)
 }
 
-// logErrors will write the error to the log file, note that the arguments errStr and logStr should be escaped correctly with url.QueryEscape() if any user data is included.
+// logErrors will write the error to the log file and answer the request with errStr and statusCode, note that the arguments errStr and logStr should be escaped correctly with url.QueryEscape() if any user data is included.
 func logErrors(w http.ResponseWriter, r *http.Request, errStr string, statusCode int, logStr string) {
 	if logger != nil {
-		logger.Println("Request:\nStatuscode:", statusCode, url.QueryEscape(logStr), url.QueryEscape(errStr), "\n", url.QueryEscape(r.Host+r.RequestURI), url.QueryEscape(r.RemoteAddr), url.QueryEscape(r.UserAgent()), url.QueryEscape(r.Referer()), url.QueryEscape(fmt.Sprintf("%v", r.PostForm)), url.QueryEscape(fmt.Sprintf("%v", r.Body)), url.QueryEscape(fmt.Sprintf("%v", r.Form)))
+		logger.Println("Request:\nStatuscode:", statusCode, url.QueryEscape(logStr), url.QueryEscape(errStr), "\n", url.QueryEscape(r.Host+r.RequestURI), url.QueryEscape(clientAddr(r)), url.QueryEscape(r.UserAgent()), url.QueryEscape(r.Referer()), url.QueryEscape(fmt.Sprintf("%v", r.PostForm)), url.QueryEscape(fmt.Sprintf("%v", r.Body)), url.QueryEscape(fmt.Sprintf("%v", r.Form)))
 	}
-	http.Error(w, errServerError, statusCode)
+	writeError(w, r, errStr, statusCode) // defined in errors.go
 }
 
 func logOK(r *http.Request, statusCode int) {
 	if logger != nil {
-		logger.Println("Request:\nStatuscode:", statusCode, url.QueryEscape(r.Host+r.RequestURI), url.QueryEscape(r.RemoteAddr), url.QueryEscape(r.UserAgent()), url.QueryEscape(r.Referer()), url.QueryEscape(fmt.Sprintf("%v", r.PostForm)), url.QueryEscape(fmt.Sprintf("%v", r.Body)), url.QueryEscape(fmt.Sprintf("%v", r.Form)))
+		logger.Println("Request:\nStatuscode:", statusCode, url.QueryEscape(r.Host+r.RequestURI), url.QueryEscape(clientAddr(r)), url.QueryEscape(r.UserAgent()), url.QueryEscape(r.Referer()), url.QueryEscape(fmt.Sprintf("%v", r.PostForm)), url.QueryEscape(fmt.Sprintf("%v", r.Body)), url.QueryEscape(fmt.Sprintf("%v", r.Form)))
 	}
 }
 
 // fugly temp function
 func listActiveLinks(w http.ResponseWriter, r *http.Request) {
-	ba := sha256.Sum256([]byte(r.URL.RawQuery + config.Salt))
-	pwd := hex.EncodeToString(ba[:])
-	if pwd == config.HashSHA256 {
+	if name, ok := authorizeAdmin(r.URL.RawQuery, roleLinks); ok { // defined in credentials.go
+		if logger != nil {
+			logger.Println("Active links listed by", name)
+		}
 		w.Header().Add("Content-Type", "text/plain")
 		resp := ""
 		for _, domain := range config.DomainNames {
@@ -255,12 +253,22 @@ func listActiveLinks(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Fprint(w, resp)
 	} else {
-		http.Error(w, errServerError, http.StatusInternalServerError)
+		http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
 	}
 }
 
+// validAdminPassword returns true if the sha256 hash of pwd and config.Salt matches the legacy config.HashSHA256
+func validAdminPassword(pwd string) bool {
+	ba := sha256.Sum256([]byte(pwd + config.Salt))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(ba[:])), []byte(config.HashSHA256)) == 1
+}
+
 func getActiveList(l *LinkLen) (resp string) {
 	l.Mutex.Lock()
+	if l.NextClear == nil {
+		l.Mutex.Unlock()
+		return
+	}
 	next := *l.NextClear
 	stop := false
 	for !stop {
@@ -281,32 +289,34 @@ func getActiveList(l *LinkLen) (resp string) {
 }
 
 func initTemplates() {
-	// defaultIndex contains the hardcoded fallback for the index page
-	defaultIndex := "<!DOCTYPE html><html lang=\"en\"><head><meta charset=\"utf-8\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\"><meta name=\"description\" content=\"Simple temporary URL shortener. Also supports temporary text blobs. 1-3 chars long or custom words.\"><meta name=\"Keywords\" content=\"temporary, temp, shortener, expiring, URL, link, redirect, generator\"><title>Temporary URL shortener</title><link rel=\"icon\" type=\"image/png\" href=\"data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAABSUlEQVQ4jZ2Tu0oDURCG90myKwERC8FKfAAfwdZCsU0bmwhWglY2Ad2zRhS0sUshsUiRRjQgMQYEG20khezZZO+5bD6LQGJINpoUfzPDfDNz5vxKQpj7qrBCTUhmkSqsUNWtjKIJ2Zq1eADRZajMWrR1Z3Py7LN2baEJiaIJSbbiYwbRVB0+emhC0gwjAPSqPwTo1QCv3RtTq9sDoBFGrFz2O+4UbLIVn/WbXxPEqVxvA3Bc9gaxzXyTVNEZXWGSdu9tAL79iOWLYbzw2QJgu+DEA5KG5F12ADh48EZy/wKkSy4AX06XxXM5G2ApJ6m7XQD2Su4Y/E/A0ZMHwEejS9IYn24qYPXKwm7175wqOhMfdyrAeA0AeDM7LMRcJxaQNCSnLz65WsBmvhn7N9Ill1wtYOO20QfM48SBmYQVKomzOe2sy1DVzcwP7InxY4zEPaQAAAAASUVORK5CYII=\"><link rel=\"stylesheet\" type=\"text/css\" href=\"shorter.css\" integrity=\"sha256-Q1KumqswQnGssQv5JsnHhB4U20pPESF8eVZw9sPxm7Y=\" crossorigin=\"anonymous\"></head><body><div class=\"content\"><div><div class=\"header\"><img src=\"logo.png\"><h1>Temp Url shortener</h1></div><form id=\"shortener\" method=\"POST\" enctype=\"multipart/form-data\"><div class=\"radio-box\"><input type=\"radio\" name=\"len\" id=\"hideCustomKey1\" value=\"1\" checked><label for=\"len\">Length 1: valid for 24h</label><input type=\"radio\" name=\"len\" id=\"hideCustomKey2\" value=\"2\"><label for=\"len\">Length 2: valid for 7d</label><input type=\"radio\" name=\"len\" id=\"hideCustomKey3\" value=\"3\"><label for=\"len\">Length 3: valid for 60d</label><input type=\"radio\" name=\"len\" id=\"showCustomKey\" value=\"custom\"><label for=\"len\">Custom key (4-64 chars): valid for 30d</label><div id=\"customDiv\"><span>Custom key:</span><input type=\"text\" name=\"custom\" class=\"inputbox\" placeholder=\"Your Custom Key Here\"></div></div><div class=\"radio-box\"><input type=\"radio\" name=\"requestType\" id=\"showURL\" value=\"url\" checked><label for=\"requestType\">Create temporary URL</label><input type=\"radio\" name=\"requestType\" id=\"showText\" value=\"text\"><label for=\"requestType\">Temporary text dump</label><div id=\"urlDiv\"><span>Submit URL to shorten:</span><input type=\"text\" name=\"url\" class=\"inputbox\" placeholder=\"Your URL Here\"></div><div id=\"textDiv\"><span>Submit text to temporarly save:</span><textarea form=\"shortener\" rows=\"7\" cols=\"80\" name=\"text\"></textarea></div></div><input type=\"submit\"></form></div><div class=\"info\"><span>Pre Alpha test site, links will be cleared during development without notice.</span></div><div class=\"tos\"><input id=\"ToS\" type=\"radio\" name=\"ToS\" /><label for=\"ToS\">Terms of Service</label><div id=\"ToSDiv\">The 7i service may not be used for any unlawful activities including but not limited to <br>scamming, fraud, transmission of viruses, trojan horses, or other malware.<br>7i reserves the right to modify anything in the 7i service without any prior notice including<br>but not limited to shutting down the service or deleting any content generated by any party.<br>By using the 7i service you acknowledge that any data sent to the 7i service will be provided <br>under the Zero-Clause BSD license (https://opensource.org/licenses/0BSD) and that you have <br>the right to upload the data. <br><br>THE 7I SERVICE IS PROVIDED \"AS IS\", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR <br>IMPLIED. USE OF THE 7I SERVICES IS SOLELY AT YOUR OWN RISK. IN NO EVENT SHALL THE <br>AUTHORS, 7I OR THE PROVIDER OF THE 7I SERVICE BE LIABLE FOR ANY CLAIM, DAMAGES <br>OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, <br>ARISING FROM, OUT OF OR IN CONNECTION WITH THE SERVICE OR SOFTWARE OR THE USE <br>OR OTHER DEALINGS IN THE SERVICE OR SOFTWARE. 7I TRIES TO LIMIT ANY UNLAWFUL <br>ACTIVITIES BY ITS USERS BUT DOES NOT WARRANT THAT THE 7I SERVICE IS SECURE, FREE <br>OF VIRUSES OR OTHER HARMFUL COMPONENTS</div></div></div></body></html>"
-	// defaultShowLink contains the hardcoded fallback for the showLink page
-	defaultShowLink := "<!DOCTYPE html><html lang=\"en\"><head><link rel=\"stylesheet\" type=\"text/css\" href=\"shorter.css\"></head><body><div class=\"content\"><div class=\"tos\">Temporary link:<br><H1><a href=\"{{.Data}}\">{{.Data}}</a></H1><br>This link will be removed {{.Timeout}}</div><div class=\"info\">Please only navigate to the link if you trust the person that generated the link.</div><div class=\"tos\">To create your own temporary links please visit <a href=\"{{.Domain}}\">{{.Domain}}</a></div></div></body></html>"
-
 	// templateMap should be used as read only after initTemplates() has returned
 	templateMap = make(map[string]*template.Template)
 	// Create index page
-	loadTemplate("index", defaultIndex)
+	loadTemplate("index")
 	// Create page for showing links
-	loadTemplate("showLink", defaultShowLink)
+	loadTemplate("showLink")
+	// Create page for errors shown to browsers, defined in errors.go
+	loadTemplate("error")
+	// Create page for unlocking password protected links, defined in unlock.go
+	loadTemplate("unlock")
+	// Create page for revealing burn after reading texts, defined in reveal.go
+	loadTemplate("reveal")
+	// Create page for decrypting encrypted pastes, defined in encrypted.go
+	loadTemplate("encrypted")
+	// Create page for viewing texts with syntax highlighting, defined in paste.go
+	loadTemplate("paste")
+	// Create page for comparing revisions, defined in diff.go
+	loadTemplate("diff")
+	setReady(&readiness.templatesLoaded) // defined in health.go
 }
 
-func loadTemplate(templateName, defaultTmplStr string) {
-	defaultTmpl := template.Must(template.New(templateName + ".tmpl").Parse(defaultTmplStr))
-
+// loadTemplate parses templateName.tmpl for every domain, the template from the built-in theme is used if the domain does not override it
+func loadTemplate(templateName string) {
 	for _, domain := range config.DomainNames {
-		tmpl, err := template.ParseFiles(filepath.Join(config.BaseDir, domain, templateName+".tmpl"))
+		tmpl, err := parsePage(domain, templateName) // defined in themes.go
 		if err != nil {
-			if logger != nil {
-				logger.Println("Missing /" + domain + "/" + templateName + ".tmpl in Template dir, fallback to default " + templateName + ".tmpl with key: " + domain + "#" + templateName)
-			}
-			templateMap[domain+"#"+templateName] = defaultTmpl
-		} else {
-			logger.Println("Template key value: ", domain+"#"+templateName)
-			templateMap[domain+"#"+templateName] = tmpl
+			log.Fatalln(err)
 		}
+		templateMap[domain+"#"+templateName] = tmpl
 	}
 }
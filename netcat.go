@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultNetcatIdleTimeout is used if Netcat.IdleTimeout is not set
+	defaultNetcatIdleTimeout = 2 * time.Second
+	// defaultNetcatReadTimeout is used if Netcat.ReadTimeout is not set
+	defaultNetcatReadTimeout = 30 * time.Second
+	// defaultNetcatMaxConnections is used if Netcat.MaxConnections is not set
+	defaultNetcatMaxConnections = 64
+	// netcatWriteTimeout is the time a client has to receive the answer
+	netcatWriteTimeout = 10 * time.Second
+)
+
+var (
+	// netcatListener is the listener opened by startNetcat, nil if the netcat listener is disabled
+	netcatListener net.Listener
+	// netcatConns counts the connections that are handled so that stopNetcat can wait for them
+	netcatConns sync.WaitGroup
+)
+
+// startNetcat opens the raw TCP listener for texts if Netcat.Address is set and serves it in a separate goroutine, the socket is opened
+// before returning so that a configuration error fails early
+func startNetcat() error {
+	if config.Netcat.Address == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", config.Netcat.Address)
+	if err != nil {
+		return err
+	}
+	if logger != nil {
+		logger.Println("Listening on tcp", l.Addr().String(), "serving netcat texts for", netcatDomain())
+	}
+	netcatListener = wrapProxyProtocol(l) // defined in proxy.go
+	setReady(&readiness.netcat)           // defined in health.go
+	go serveNetcat(netcatListener)
+	return nil
+}
+
+// stopNetcat closes the netcat listener and waits until the texts that are being read have been added or ctx is done, used by serve
+// when shorter is shutting down
+func stopNetcat(ctx context.Context) {
+	if netcatListener == nil {
+		return
+	}
+	netcatListener.Close()
+	done := make(chan struct{})
+	go func() {
+		netcatConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if logger != nil {
+			logger.Println("Netcat connections did not finish before the shutdown timeout")
+		}
+	}
+}
+
+// netcatDomain returns the domain the texts sent to the netcat listener are added to
+func netcatDomain() string {
+	if config.Netcat.Domain != "" {
+		return config.Netcat.Domain
+	}
+	return config.DomainNames[0]
+}
+
+// serveNetcat accepts connections on l, at most Netcat.MaxConnections connections are read at the same time and further connections wait
+// in the backlog of the listener. If the listener fails the error is logged and the HTTP listeners keep serving, /readyz reports the failure
+func serveNetcat(l net.Listener) {
+	maxConnections := config.Netcat.MaxConnections
+	if maxConnections == 0 {
+		maxConnections = defaultNetcatMaxConnections
+	}
+	slots := make(chan struct{}, maxConnections)
+	for {
+		slots <- struct{}{}
+		conn, err := l.Accept()
+		if err != nil {
+			<-slots
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				time.Sleep(time.Second)
+				continue
+			}
+			setNotReady(&readiness.netcat) // defined in health.go
+			if errors.Is(err, net.ErrClosed) {
+				// closed by stopNetcat
+				return
+			}
+			log.Println("Netcat listener failed:", err)
+			if logger != nil {
+				logger.Println("Netcat listener failed:", err)
+			}
+			return
+		}
+		netcatConns.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				netcatConns.Done()
+			}()
+			handleNetcat(conn)
+		}()
+	}
+}
+
+// handleNetcat reads the text sent on conn, adds it as a text link with the shortest free key and writes the link back. The same checks
+// as for texts sent over HTTP are done, errors are written back as a single line
+func handleNetcat(conn net.Conn) {
+	defer conn.Close()
+	domain := netcatDomain()
+	// the request is only used to find the rate limiters and the default language of the domain
+	r := &http.Request{Host: domain, Header: http.Header{}}
+	clientKey := conn.RemoteAddr().String()
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientKey = ipRateLimitKey(addr.IP, clientKey) // defined in ratelimit.go
+	}
+
+	text, errMsg := "", ""
+	if ok, _ := getRateLimiters(r).Create.Allow(clientKey); !ok {
+		errMsg = errTooManyRequests
+	} else if lowRAM() {
+		errMsg = errLowRAM
+	} else {
+		text, errMsg = readNetcatText(conn)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(netcatWriteTimeout))
+	if errMsg != "" {
+		if logger != nil {
+			logger.Println("Netcat text from", clientKey, "failed:", errMsg)
+		}
+		io.WriteString(conn, localize(r, errMsg)+"\n")
+		return
+	}
+
+	data, isCompressed := compressText(text) // defined in revisions.go
+	now := time.Now()
+	lnk := &Link{LinkType: "text", Data: data, IsCompressed: isCompressed, Times: -1, Updated: now, Created: now}
+	key, err := addShortestText(domain, lnk, 0) // defined in upload.go
+	if err != nil {
+		if logger != nil {
+			logger.Println("Netcat text from", clientKey, "failed:", err)
+		}
+		io.WriteString(conn, localize(r, err.Error())+"\n")
+		return
+	}
+	scheme := "https"
+	if config.NoTLS {
+		scheme = "http"
+	}
+	if logger != nil {
+		logger.Println("Netcat text from", clientKey, "added with key", key, "on", domain)
+	}
+	io.WriteString(conn, scheme+"://"+domain+"/"+key+"\n")
+}
+
+// readNetcatText reads the text from conn until the client closes its side of the connection or has not sent anything for IdleTimeout.
+// An error message is returned if the text is empty, larger than MaxFileSize or not sent within ReadTimeout
+func readNetcatText(conn net.Conn) (text, errMsg string) {
+	idleTimeout, readTimeout := config.Netcat.IdleTimeout, config.Netcat.ReadTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultNetcatIdleTimeout
+	}
+	if readTimeout == 0 {
+		readTimeout = defaultNetcatReadTimeout
+	}
+	// RemoteAddr reads the PROXY protocol header first, which resets the read deadline
+	conn.RemoteAddr()
+	deadline := time.Now().Add(readTimeout)
+
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		readDeadline, last := time.Now().Add(idleTimeout), false
+		if !readDeadline.Before(deadline) {
+			readDeadline, last = deadline, true
+		}
+		conn.SetReadDeadline(readDeadline)
+		n, err := conn.Read(chunk)
+		buf.Write(chunk[:n])
+		if int64(buf.Len()) > config.MaxFileSize {
+			return "", errTooLarge
+		}
+		if err == io.EOF {
+			break
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if last {
+				return "", errNetcatTimeout
+			}
+			// nc without -N or -q keeps the connection open after the input ends
+			break
+		}
+		if err != nil {
+			return "", errInvalidRequest
+		}
+	}
+	if strings.TrimSpace(buf.String()) == "" {
+		return "", errEmptyText
+	}
+	return buf.String(), ""
+}
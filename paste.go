@@ -0,0 +1,103 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pasteVars are the template variables of paste.tmpl
+type pasteVars struct {
+	Domain string
+	// Key is the key of the text link, the raw text is available at /Key/raw
+	Key string
+	// Language is the key of the language in languages and LanguageName its name
+	Language     string
+	LanguageName string
+	// Lines contains the highlighted lines, it is empty if Markdown is set
+	Lines []pasteLine
+	// Markdown is the rendered text if Language is markdown
+	Markdown template.HTML
+	Expires  time.Time
+	// Burned is set if the text was deleted when it was revealed, the language select and raw link are not shown since the text is gone
+	Burned bool
+	// Revision is the shown revision, Current the newest revision and Revisions the numbers of all revisions that are still available
+	Revision  int
+	Current   int
+	Revisions []int
+	// Parent and ParentRevision are the text and revision this text was forked from, defined in revisions.go
+	Parent         string
+	ParentRevision int
+	// Editable is set if new revisions can be added with the edit secret and Forkable if the text can be forked
+	Editable bool
+	Forkable bool
+	// Text is the shown text, it fills the form for a new revision
+	Text string
+	// Languages are the options of the language select
+	Languages []languageOption
+	Site      *siteVars
+	L         *localizer
+}
+
+// pasteLanguage returns the language text is shown as, the lang query parameter overrides the language chosen when the link was created
+// and if neither is set the language is detected from the text
+func pasteLanguage(r *http.Request, lnk *Link, text string) string {
+	if lang := r.URL.Query().Get("lang"); languages[lang] != nil {
+		return lang
+	}
+	if languages[lnk.Language] != nil {
+		return lnk.Language
+	}
+	return detectLanguage(text) // defined in highlight.go
+}
+
+// wantsPasteView returns true if the text link should be answered with the paste view instead of the raw text, browsers get the paste
+// view unless the path after the key is /raw while curl and other clients always get the raw text
+func wantsPasteView(r *http.Request, key string) bool {
+	rest := strings.TrimPrefix(r.URL.Path, "/"+key)
+	if rest == "/raw" || strings.HasPrefix(rest, "/raw/") {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// servePaste answers r with paste.tmpl showing the text of lnk with line numbers and syntax highlighting or rendered as Markdown
+func servePaste(w http.ResponseWriter, r *http.Request, lnk *Link, key string) {
+	rev, _ := requestedRevision(r, lnk) // defined in revisions.go
+	text, ok := revisionText(lnk, rev)
+	if !ok {
+		logErrors(w, r, errRevisionNotFound, http.StatusNotFound, "")
+		return
+	}
+	t, found := templateMap[r.Host+"#paste"]
+	if !found {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to load paste template: "+r.Host+"#paste")
+		return
+	}
+	lang := pasteLanguage(r, lnk, text)
+	vars := pasteVars{Domain: requestScheme(r) + "://" + r.Host, Key: key, Language: lang, LanguageName: languages[lang].Name, Expires: lnk.Timeout,
+		Burned: lnk.BurnAfterReading, Revision: rev, Current: currentRevision(lnk), Revisions: revisionNumbers(lnk),
+		Editable: revisable(lnk) && lnk.EditHash != "" && maxRevisions() > 0, Forkable: revisable(lnk) && lnk.PasswordHash == "",
+		Languages: languageOptions(), Site: sites[r.Host], L: getLocalizer(r)}
+	// the parent is only linked while it exists, its key can be reused by another text once it is removed. Defined in revisions.go
+	if lnk.Parent != "" {
+		if _, goneMsg := findParent(r.Host, lnk); goneMsg == "" {
+			vars.Parent, vars.ParentRevision = lnk.Parent, lnk.ParentRevision
+		}
+	}
+	if vars.Editable && rev == vars.Current {
+		vars.Text = text
+	}
+	if lang == langMarkdown {
+		vars.Markdown = renderMarkdown(text) // defined in markdown.go
+	} else {
+		vars.Lines = highlight(text, lang) // defined in highlight.go
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, "paste.tmpl", vars); err != nil {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to Execute paste template: "+r.Host+"#paste")
+		return
+	}
+	logOK(r, http.StatusOK)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is the maximum time a trusted proxy is given to send the PROXY protocol header
+	proxyHeaderTimeout = 10 * time.Second
+	// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header including the trailing CRLF
+	proxyV1MaxLen = 107
+)
+
+var (
+	// trustedProxyNets contains the parsed networks from config.TrustedProxies
+	trustedProxyNets []*net.IPNet
+	// proxyV2Signature is the fixed 12 byte signature that starts every PROXY protocol v2 header
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// initTrustedProxies parses config.TrustedProxies, each entry can either be a CIDR network or a single IP address
+func initTrustedProxies() error {
+	trustedProxyNets = nil
+	for _, proxy := range config.TrustedProxies {
+		ipNet, err := parseTrustedProxy(proxy)
+		if err != nil {
+			return err
+		}
+		trustedProxyNets = append(trustedProxyNets, ipNet)
+	}
+	return nil
+}
+
+// parseTrustedProxy parses a single TrustedProxies entry
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if !strings.Contains(proxy, "/") {
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, errors.New("invalid TrustedProxies entry: " + proxy)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(proxy)
+	if err != nil {
+		return nil, errors.New("invalid TrustedProxies entry: " + proxy)
+	}
+	return ipNet, nil
+}
+
+// isTrustedProxy returns true if ip is part of any of the networks in config.TrustedProxies
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAddrKey is the context key for the address of the socket peer of a connection that started with a PROXY protocol header
+type peerAddrKey struct{}
+
+// proxyConnContext saves the address of the socket peer in the connection context before RemoteAddr is replaced with the client address
+// from the PROXY protocol header, use it as ConnContext of every http.Server that serves a listener from wrapProxyProtocol
+func proxyConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = tlsConn.NetConn()
+	}
+	if pc, ok := c.(*proxyConn); ok {
+		return context.WithValue(ctx, peerAddrKey{}, pc.Conn.RemoteAddr().String())
+	}
+	return ctx
+}
+
+// peerAddr returns the address of the socket peer of r, this is the proxy and not the client address from the PROXY protocol header
+func peerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// isTrustedPeer returns true if the socket peer of r is a trusted proxy
+func isTrustedPeer(r *http.Request) bool {
+	return isTrustedAddr(peerAddr(r))
+}
+
+// isTrustedAddr returns true if the peer address addr belongs to a trusted proxy.
+// Peers connected over a unix socket are trusted if any TrustedProxies are configured since access to the socket is controlled by its permissions
+func isTrustedAddr(addr string) bool {
+	if addr == "@" || addr == "" {
+		return len(trustedProxyNets) > 0
+	}
+	return isTrustedProxy(addrIP(addr))
+}
+
+// remoteIP returns the IP of the directly connected peer of r, or of the client from the PROXY protocol header if one was sent
+func remoteIP(r *http.Request) net.IP {
+	return addrIP(r.RemoteAddr)
+}
+
+// addrIP returns the IP of a host:port or plain host address
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the IP of the client that made the request r. Forwarding headers are only honored if the request was sent by a trusted proxy,
+// the forwarding chain is walked from the right and the first address that is not a trusted proxy is returned.
+// The walk starts at RemoteAddr, so the headers are ignored when a PROXY protocol header already named a client that is not a trusted proxy.
+// If the client IP can not be determined nil is returned.
+func clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !isTrustedAddr(r.RemoteAddr) {
+		return ip
+	}
+	chain := forwardedFor(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := net.ParseIP(chain[i])
+		if hop == nil {
+			// unparsable or obfuscated addresses can not be trusted any further
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientAddr returns the client IP of r as a string suitable for logging
+func clientAddr(r *http.Request) string {
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// requestScheme returns the scheme used by the client, either "http" or "https".
+// X-Forwarded-Proto and the proto parameter of the Forwarded header are only honored for requests sent by a trusted proxy, the trust is
+// decided from the socket peer since RemoteAddr contains the client address when the PROXY protocol is used.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if !isTrustedPeer(r) {
+		return "http"
+	}
+	var proto string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range parseForwarded(forwarded) {
+			if p, ok := element["proto"]; ok {
+				proto = p
+			}
+		}
+	} else if xfp := r.Header.Get("X-Forwarded-Proto"); xfp != "" {
+		proto = strings.TrimSpace(strings.Split(xfp, ",")[0])
+	}
+	if strings.EqualFold(proto, "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedFor returns the forwarding chain from the Forwarded header if present and from X-Forwarded-For otherwise, the client is the first element
+func forwardedFor(r *http.Request) (chain []string) {
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range parseForwarded(forwarded) {
+			if node, ok := element["for"]; ok {
+				chain = append(chain, forwardedNodeIP(node))
+			}
+		}
+		return chain
+	}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			chain = append(chain, strings.TrimSpace(hop))
+		}
+	}
+	return chain
+}
+
+// parseForwarded parses the RFC 7239 Forwarded header values into one map of lower case parameter names to values per forwarded element
+func parseForwarded(values []string) (elements []map[string]string) {
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			params := make(map[string]string)
+			for _, pair := range strings.Split(element, ";") {
+				i := strings.IndexByte(pair, '=')
+				if i < 0 {
+					continue
+				}
+				name := strings.ToLower(strings.TrimSpace(pair[:i]))
+				params[name] = strings.Trim(strings.TrimSpace(pair[i+1:]), "\"")
+			}
+			elements = append(elements, params)
+		}
+	}
+	return elements
+}
+
+// forwardedNodeIP strips the optional port and IPv6 brackets from a Forwarded node, e.g. "[2001:db8::1]:4711" becomes "2001:db8::1"
+func forwardedNodeIP(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if i := strings.IndexByte(node, ']'); i > 0 {
+			return node[1:i]
+		}
+		return node
+	}
+	if strings.Count(node, ":") == 1 {
+		return node[:strings.IndexByte(node, ':')]
+	}
+	return node
+}
+
+// wrapProxyProtocol wraps l if config.ProxyProtocol is set so that connections from trusted proxies are required to start with a PROXY protocol v1 or v2 header
+func wrapProxyProtocol(l net.Listener) net.Listener {
+	if config.ProxyProtocol {
+		return &proxyListener{Listener: l}
+	}
+	return l
+}
+
+// proxyListener wraps accepted connections in proxyConn
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// proxyConn reads the PROXY protocol header on first use so that a slow proxy only blocks its own connection and not the accept loop
+type proxyConn struct {
+	net.Conn
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.remoteAddr = c.Conn.RemoteAddr()
+		switch addr := c.remoteAddr.(type) {
+		case *net.TCPAddr:
+			if !isTrustedProxy(addr.IP) {
+				return
+			}
+		case *net.UnixAddr:
+			if len(trustedProxyNets) == 0 {
+				return
+			}
+		default:
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if logger != nil {
+				logger.Println("Invalid PROXY protocol header from", c.Conn.RemoteAddr().String(), err)
+			}
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and returns the source address, addr is nil if the proxy did not provide a source address
+func readProxyHeader(r *bufio.Reader) (addr net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case '\r':
+		return readProxyHeaderV2(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 parses the human readable header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("invalid PROXY v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid PROXY v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 parses the binary header, only the source address of TCP over IPv4 and IPv6 is used and any TLVs are skipped
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("invalid PROXY v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command, e.g. health checks from the proxy itself
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, errors.New("unsupported PROXY v2 command")
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// unsupported address families are accepted but the address of the proxy is kept
+	return nil, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a PROXY protocol v2 header with the version and command byte verCmd, the address family and the payload
+func proxyV2Header(verCmd, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		addr    string
+		wantErr bool
+	}{
+		{"tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET /", "192.0.2.1:56324", false},
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\n", "[2001:db8::1]:4711", false},
+		{"unknown keeps the proxy address", "PROXY UNKNOWN\r\n", "", false},
+		{"truncated", "PROXY TCP4 192.0.2.1 192.0", "", true},
+		{"oversized", "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n", "", true},
+		{"missing CR", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", "", true},
+		{"wrong prefix", "PROXZ TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "", true},
+		{"missing field", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "", true},
+		{"invalid ip", "PROXY TCP4 192.0.2.300 192.0.2.2 56324 443\r\n", "", true},
+		{"invalid port", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n", "", true},
+		{"unsupported protocol", "PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			checkProxyAddr(t, addr, err, tt.addr, tt.wantErr)
+		})
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:34], 4711)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		addr    string
+		wantErr bool
+	}{
+		{"tcp4", proxyV2Header(0x21, 0x11, ipv4), "192.0.2.1:56324", false},
+		{"tcp6", proxyV2Header(0x21, 0x21, ipv6), "[2001:db8::1]:4711", false},
+		{"tcp4 with TLVs", proxyV2Header(0x21, 0x11, append(append([]byte{}, ipv4...), 0x04, 0, 1, 'x')), "192.0.2.1:56324", false},
+		{"local command", proxyV2Header(0x20, 0x00, nil), "", false},
+		{"unix family keeps the proxy address", proxyV2Header(0x21, 0x31, make([]byte, 216)), "", false},
+		{"truncated header", proxyV2Header(0x21, 0x11, ipv4)[:14], "", true},
+		{"truncated payload", proxyV2Header(0x21, 0x11, ipv4)[:20], "", true},
+		{"short ipv4 block", proxyV2Header(0x21, 0x11, ipv4[:8]), "", true},
+		{"short ipv6 block", proxyV2Header(0x21, 0x21, ipv6[:20]), "", true},
+		{"bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), "", true},
+		{"unsupported version", proxyV2Header(0x11, 0x11, ipv4), "", true},
+		{"unsupported command", proxyV2Header(0x22, 0x11, ipv4), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			checkProxyAddr(t, addr, err, tt.addr, tt.wantErr)
+		})
+	}
+}
+
+func TestReadProxyHeaderMissing(t *testing.T) {
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))); err == nil {
+		t.Error("expected an error for a connection without a PROXY header")
+	}
+}
+
+// checkProxyAddr compares the result of readProxyHeader with the expected address, an empty want means that no address is returned
+func checkProxyAddr(t *testing.T, addr net.Addr, err error, want string, wantErr bool) {
+	t.Helper()
+	if wantErr {
+		if err == nil {
+			t.Fatalf("expected an error, got address %v", addr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want == "" {
+		if addr != nil {
+			t.Fatalf("expected no address, got %v", addr)
+		}
+		return
+	}
+	if addr == nil || addr.String() != want {
+		t.Fatalf("got address %v, want %s", addr, want)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8:ffff::1"}
+	if err := initTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		config.TrustedProxies = nil
+		initTrustedProxies()
+	}()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct client", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer can not spoof X-Forwarded-For", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.1"},
+		{"untrusted peer can not spoof Forwarded", "192.0.2.1:1234", map[string]string{"Forwarded": "for=198.51.100.1"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed chain stops at the first untrusted hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"spoofed trusted address before the client", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 198.51.100.1"}, "198.51.100.1"},
+		{"obfuscated hop is not trusted further", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"only trusted hops", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.2"}, "10.0.0.2"},
+		{"forwarded with port and quotes", "10.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::7]:4711";proto=https, for=10.0.0.2`}, "2001:db8::7"},
+		{"forwarded takes precedence", "10.0.0.1:1234", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "203.0.113.7"}, "198.51.100.1"},
+		{"forwarded obfuscated identifier", "10.0.0.1:1234", map[string]string{"Forwarded": "for=_hidden, for=198.51.100.1"}, "198.51.100.1"},
+		{"trusted ipv6 proxy", "[2001:db8:ffff::1]:443", map[string]string{"X-Forwarded-For": "2001:db8::9"}, "2001:db8::9"},
+		{"unix socket peer is trusted", "@", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if got := clientIP(r); got.String() != tt.want {
+				t.Errorf("clientIP() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := initTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		config.TrustedProxies = nil
+		initTrustedProxies()
+	}()
+
+	tests := []struct {
+		remoteAddr string
+		peerAddr   string
+		headers    map[string]string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", map[string]string{"X-Forwarded-Proto": "https"}, "http"},
+		{"10.0.0.1:1234", "", map[string]string{"X-Forwarded-Proto": "https"}, "https"},
+		{"10.0.0.1:1234", "", map[string]string{"X-Forwarded-Proto": "HTTPS, http"}, "https"},
+		{"10.0.0.1:1234", "", map[string]string{"Forwarded": "for=198.51.100.1;proto=https"}, "https"},
+		{"10.0.0.1:1234", "", map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-Proto": "https"}, "http"},
+		// with the PROXY protocol RemoteAddr is the client and the trust is decided from the socket peer
+		{"192.0.2.1:1234", "10.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, "https"},
+		{"10.0.0.1:1234", "192.0.2.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, "http"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		if tt.peerAddr != "" {
+			r = r.WithContext(context.WithValue(context.Background(), peerAddrKey{}, tt.peerAddr))
+		}
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		if got := requestScheme(r); got != tt.want {
+			t.Errorf("requestScheme(%s, %v) = %s, want %s", tt.remoteAddr, tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPProxyProtocol(t *testing.T) {
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := initTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		config.TrustedProxies = nil
+		initTrustedProxies()
+	}()
+
+	// the client from the PROXY protocol header can not spoof X-Forwarded-For even though the socket peer is a trusted proxy
+	r := &http.Request{RemoteAddr: "192.0.2.1:1234", Header: http.Header{}}
+	r = r.WithContext(context.WithValue(context.Background(), peerAddrKey{}, "10.0.0.1:1234"))
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := clientIP(r); got.String() != "192.0.2.1" {
+		t.Errorf("clientIP() = %v, want 192.0.2.1", got)
+	}
+}
+
+func TestProxyConnContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx := proxyConnContext(context.Background(), server)
+	if _, ok := ctx.Value(peerAddrKey{}).(string); ok {
+		t.Error("expected no peer address for a connection without the PROXY protocol")
+	}
+	ctx = proxyConnContext(context.Background(), &proxyConn{Conn: server})
+	if addr, _ := ctx.Value(peerAddrKey{}).(string); addr != server.RemoteAddr().String() {
+		t.Errorf("got peer address %q, want %q", addr, server.RemoteAddr().String())
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket tracks the remaining tokens for a single client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client, a zero Rate disables the limiter
+type rateLimiter struct {
+	mutex   sync.Mutex
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+}
+
+// domainRateLimiters contains the rate limiters used for a single domain
+type domainRateLimiters struct {
+	Create       *rateLimiter
+	Lookup       *rateLimiter
+	FailedLookup *rateLimiter
+	AdminLogin   *rateLimiter
+}
+
+var (
+	// rateLimiters maps each domain in config.DomainNames to its rate limiters
+	rateLimiters map[string]*domainRateLimiters
+	// defaultAdminLoginLimit is used if AdminLogin is not set, every admin request verifies the password with argon2id so the budget
+	// can not be disabled
+	defaultAdminLoginLimit = RateLimit{Rate: 30, Per: time.Hour, Burst: 10}
+)
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// refill adds the tokens earned since the last request to b and returns the maximum number of tokens a bucket can hold, l.mutex must be held by the caller
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	burst := float64(l.limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.ratePerSecond())
+	b.last = now
+	return burst
+}
+
+func (l *rateLimiter) ratePerSecond() float64 {
+	per := l.limit.Per
+	if per <= 0 {
+		per = time.Minute
+	}
+	return float64(l.limit.Rate) / per.Seconds()
+}
+
+// bucket returns the bucket for key, creating a full bucket if key has not been seen before, l.mutex must be held by the caller
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{last: now}
+		b.tokens = float64(l.limit.Burst)
+		if b.tokens < 1 {
+			b.tokens = 1
+		}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// Allow consumes one token for key and returns true if the request is within the budget, if not retryAfter specifies when the next token will be available
+func (l *rateLimiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	if l == nil || l.limit.Rate <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b := l.bucket(key, now)
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, l.wait(b)
+}
+
+// Blocked returns true without consuming a token if key has used up its budget
+func (l *rateLimiter) Blocked(key string) (blocked bool, retryAfter time.Duration) {
+	if l == nil || l.limit.Rate <= 0 {
+		return false, 0
+	}
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return false, 0
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		return false, 0
+	}
+	return true, l.wait(b)
+}
+
+// wait returns the time until b has a full token, l.mutex must be held by the caller
+func (l *rateLimiter) wait(b *tokenBucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.ratePerSecond() * float64(time.Second))
+}
+
+// cleanup removes all buckets that have been refilled to their burst size since they would be recreated as full buckets anyway
+func (l *rateLimiter) cleanup() {
+	if l == nil || l.limit.Rate <= 0 {
+		return
+	}
+	now := time.Now()
+	l.mutex.Lock()
+	for key, b := range l.buckets {
+		if l.refill(b, now) <= b.tokens {
+			delete(l.buckets, key)
+		}
+	}
+	l.mutex.Unlock()
+}
+
+// initRateLimiters creates the rate limiters for all domains in config.DomainNames using the per domain RateLimits if set and config.RateLimits otherwise
+func initRateLimiters() {
+	rateLimiters = make(map[string]*domainRateLimiters)
+	for _, domain := range config.DomainNames {
+		limits := config.RateLimits
+		if domainConf, ok := config.Domains[domain]; ok && domainConf.RateLimits != nil {
+			limits = *domainConf.RateLimits
+		}
+		if limits.AdminLogin.Rate <= 0 {
+			limits.AdminLogin = defaultAdminLoginLimit
+		}
+		rateLimiters[domain] = &domainRateLimiters{
+			Create:       newRateLimiter(limits.Create),
+			Lookup:       newRateLimiter(limits.Lookup),
+			FailedLookup: newRateLimiter(limits.FailedLookup),
+			AdminLogin:   newRateLimiter(limits.AdminLogin),
+		}
+	}
+	go rateLimitCleanupRoutine()
+}
+
+// rateLimitCleanupRoutine periodically removes idle buckets so that the memory used by the rate limiters does not grow without bound
+func rateLimitCleanupRoutine() {
+	for {
+		time.Sleep(time.Minute * 5)
+		for _, limiters := range rateLimiters {
+			limiters.Create.cleanup()
+			limiters.Lookup.cleanup()
+			limiters.FailedLookup.cleanup()
+			limiters.AdminLogin.cleanup()
+		}
+	}
+}
+
+// getRateLimiters returns the rate limiters for the host of r, if the host is not a valid domain the returned limiters are all nil and a nil *rateLimiter allows all requests
+func getRateLimiters(r *http.Request) *domainRateLimiters {
+	if limiters, ok := rateLimiters[r.Host]; ok {
+		return limiters
+	}
+	return &domainRateLimiters{}
+}
+
+// rateLimitKey returns the key used to rate limit the client of r, IPv6 addresses are aggregated to their /64 prefix since a single client usually controls a whole /64
+func rateLimitKey(r *http.Request) string {
+	return ipRateLimitKey(clientIP(r), r.RemoteAddr)
+}
+
+// ipRateLimitKey returns the rate limit key for ip, fallback is used if ip is nil
+func ipRateLimitKey(ip net.IP, fallback string) string {
+	if ip == nil {
+		return fallback
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// allowRequest consumes a token from limiter for the client of r and writes a 429 response if the client has exceeded its budget
+func allowRequest(w http.ResponseWriter, r *http.Request, limiter *rateLimiter, budget string) bool {
+	ok, retryAfter := limiter.Allow(rateLimitKey(r))
+	if !ok {
+		tooManyRequests(w, r, retryAfter, budget)
+	}
+	return ok
+}
+
+// tooManyRequests writes a 429 response with a Retry-After header rounded up to the nearest second
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, budget string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	if logger != nil {
+		logger.Println("Rate limit exceeded for budget", budget, "by", rateLimitKey(r), "retry after", seconds, "seconds")
+	}
+	logOK(r, http.StatusTooManyRequests)
+	writeError(w, r, errTooManyRequests, http.StatusTooManyRequests) // defined in errors.go
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// redirectDirect answers url links with an HTTP redirect
+	redirectDirect = "direct"
+	// redirectInterstitial shows showLink.tmpl with the target of the link, this is the default
+	redirectInterstitial = "interstitial"
+	// redirectCountdown shows showLink.tmpl and forwards to the target after CountdownSeconds
+	redirectCountdown = "countdown"
+	// defaultCountdownSeconds is used if CountdownSeconds is not set
+	defaultCountdownSeconds = 5
+	// maxUnsuspiciousURLLen is the longest url that is not flagged as suspicious
+	maxUnsuspiciousURLLen = 512
+)
+
+// validRedirectModes contains the valid values of RedirectMode and of the redirect form field
+var validRedirectModes = map[string]bool{redirectDirect: true, redirectInterstitial: true, redirectCountdown: true}
+
+// redirectMode returns the redirect mode for lnk on domain, the mode of the link overrides the mode of the domain which overrides the global mode
+func redirectMode(domain string, lnk *Link) string {
+	if lnk.Redirect != "" {
+		return lnk.Redirect
+	}
+	if dc, ok := config.Domains[domain]; ok && dc.RedirectMode != "" {
+		return dc.RedirectMode
+	}
+	if config.RedirectMode != "" {
+		return config.RedirectMode
+	}
+	return redirectInterstitial
+}
+
+// redirectStatus returns the status code used for direct redirects on domain
+func redirectStatus(domain string) int {
+	if dc, ok := config.Domains[domain]; ok && dc.RedirectStatus != 0 {
+		return dc.RedirectStatus
+	}
+	if config.RedirectStatus != 0 {
+		return config.RedirectStatus
+	}
+	return http.StatusFound
+}
+
+// countdownSeconds returns the number of seconds the countdown page is shown on domain before forwarding
+func countdownSeconds(domain string) int {
+	if dc, ok := config.Domains[domain]; ok && dc.CountdownSeconds != 0 {
+		return dc.CountdownSeconds
+	}
+	if config.CountdownSeconds != 0 {
+		return config.CountdownSeconds
+	}
+	return defaultCountdownSeconds
+}
+
+// suspiciousURL returns the reasons why link looks like it could be used to mislead the user, links with any reason are always shown
+// on the interstitial page with the trust warning regardless of the redirect mode. The reasons are user facing messages
+func suspiciousURL(link string) (reasons []string) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return []string{"The link could not be parsed"}
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		reasons = append(reasons, "The link contains a user name, the real host is the part after the @")
+	}
+	if net.ParseIP(host) != nil {
+		reasons = append(reasons, "The link points to an IP address instead of a domain name")
+	}
+	for _, label := range strings.Split(strings.ToLower(host), ".") {
+		if strings.HasPrefix(label, "xn--") {
+			reasons = append(reasons, "The domain name contains international characters that can look like other characters")
+			break
+		}
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		reasons = append(reasons, "The link uses an unusual port")
+	}
+	if strings.Count(host, ".") >= 4 {
+		reasons = append(reasons, "The domain name has an unusual number of subdomains")
+	}
+	if len(link) > maxUnsuspiciousURLLen {
+		reasons = append(reasons, "The link is unusually long")
+	}
+	for _, domain := range config.DomainNames {
+		if strings.EqualFold(u.Host, domain) {
+			reasons = append(reasons, "The link points to another short link")
+			break
+		}
+	}
+	return reasons
+}
+
+// prefixTarget returns the url a request for the prefix link with the url base is forwarded to. The path after the key is appended to
+// the path of base and the query is appended to the query of base, the path is kept in its escaped form and dot segments as well as segments
+// with an escaped / or a \ are rejected so that the target can never leave the path of base, not even after the target unescapes the path
+func prefixTarget(base string, r *http.Request) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", errors.New(errServerError)
+	}
+	// the key never contains a /, the rest of the path is everything from the first / after the leading /
+	rest := ""
+	escaped := r.URL.EscapedPath()
+	if i := strings.Index(escaped[1:], "/"); i >= 0 {
+		rest = escaped[1+i:]
+	}
+	for _, segment := range strings.Split(rest, "/") {
+		if unescaped, err := url.PathUnescape(segment); err != nil || unescaped == "." || unescaped == ".." || strings.ContainsAny(unescaped, `/\`) {
+			return "", errors.New(errInvalidPrefixPath)
+		}
+	}
+	if rest != "" {
+		rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + rest
+		if u.Path, err = url.PathUnescape(rawPath); err != nil {
+			return "", errors.New(errInvalidPrefixPath)
+		}
+		u.RawPath = rawPath
+	}
+	if r.URL.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&" + r.URL.RawQuery
+		} else {
+			u.RawQuery = r.URL.RawQuery
+		}
+	}
+	target := u.String()
+	if !validURL(target) {
+		return "", errors.New(errInvalidPrefixPath)
+	}
+	return target, nil
+}
+
+// serveURLLink answers a request for the url link lnk according to its redirect mode, target is the url the request is forwarded to
+func serveURLLink(w http.ResponseWriter, r *http.Request, lnk *Link, target string) {
+	reasons := suspiciousURL(target)
+	mode := redirectMode(r.Host, lnk)
+	if mode == redirectDirect && len(reasons) == 0 {
+		status := redirectStatus(r.Host)
+		if r.Method == http.MethodPost {
+			// a 307 would repeat the POST of the unlock form to the target
+			status = http.StatusSeeOther
+		}
+		logOK(r, status)
+		http.Redirect(w, r, target, status)
+		return
+	}
+
+	t, ok := templateMap[r.Host+"#showLink"]
+	if !ok {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to load showLink template: "+r.Host+"#showLink")
+		return
+	}
+	tmplArgs := newShowLinkVars(r, requestScheme(r), target, lnk.Timeout) // defined in themes.go
+	tmplArgs.Reasons = reasons
+	if mode == redirectCountdown && len(reasons) == 0 {
+		tmplArgs.Countdown = countdownSeconds(r.Host)
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, "showLink.tmpl", tmplArgs); err != nil {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to Execute showLink template: "+r.Host+"#showLink")
+		return
+	}
+	logOK(r, http.StatusOK)
+}
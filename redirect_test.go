@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPrefixTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"key only", "https://example.com/docs/", "/abc", "https://example.com/docs/", false},
+		{"path", "https://example.com/docs/", "/abc/guide/intro", "https://example.com/docs/guide/intro", false},
+		{"query", "https://example.com/docs/?v=1", "/abc/page?lang=sv", "https://example.com/docs/page?v=1&lang=sv", false},
+		{"escaped space is kept", "https://example.com/docs/", "/abc/a%20b", "https://example.com/docs/a%20b", false},
+		{"dot dot", "https://example.com/docs/", "/abc/../admin", "", true},
+		{"dot", "https://example.com/docs/", "/abc/./page", "", true},
+		{"escaped dot dot", "https://example.com/docs/", "/abc/%2e%2e/admin", "", true},
+		{"escaped slash", "https://example.com/docs/", "/abc/..%2F..%2Fadmin", "", true},
+		{"escaped slash in a name", "https://example.com/docs/", "/abc/a%2fb", "", true},
+		{"escaped backslash", "https://example.com/docs/", "/abc/..%5C..%5Cadmin", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse("https://short.example" + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := prefixTarget(tt.base, &http.Request{URL: u})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("prefixTarget() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// revealVars are the template variables of reveal.tmpl
+type revealVars struct {
+	Domain string
+	// Key is the key of the text that is revealed
+	Key  string
+	Site *siteVars
+	L    *localizer
+}
+
+// writeRevealPage answers a GET request for a burn after reading text. Browsers get reveal.tmpl with a button that sends the POST request
+// that reveals and removes the text, all other clients get an error that explains how to reveal the text. Link preview bots only send
+// GET requests so they never remove the text
+func writeRevealPage(w http.ResponseWriter, r *http.Request, key string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		logErrors(w, r, errRevealRequired, http.StatusPreconditionRequired, "")
+		return
+	}
+	t, ok := templateMap[r.Host+"#reveal"]
+	if !ok {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to load reveal template: "+r.Host+"#reveal")
+		return
+	}
+	vars := revealVars{Domain: requestScheme(r) + "://" + r.Host, Key: key, Site: sites[r.Host], L: getLocalizer(r)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, "reveal.tmpl", vars); err != nil && logger != nil {
+		logger.Println("ERROR executing template reveal.tmpl for host:", r.Host, "with the error:", err)
+	}
+	logOK(r, http.StatusOK)
+}
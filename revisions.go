@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// editSecretHeader can be used by API clients instead of the form field secret to add a revision
+	editSecretHeader = "X-Edit-Secret"
+	// editSecretLen is the number of random bytes in an edit secret
+	editSecretLen = 18
+	// defaultMaxRevisions is used if MaxRevisions is not set
+	defaultMaxRevisions = 10
+)
+
+// maxRevisions returns the number of older revisions kept for each text, 0 if revisions are disabled
+func maxRevisions() int {
+	switch {
+	case config.MaxRevisions < 0:
+		return 0
+	case config.MaxRevisions == 0:
+		return defaultMaxRevisions
+	}
+	return config.MaxRevisions
+}
+
+// newEditSecret returns a new random edit secret and its hash, the secret is only shown once when the text is created
+func newEditSecret() (secret, hash string, err error) {
+	b := make([]byte, editSecretLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	return secret, editSecretHash(secret), nil
+}
+
+// editSecretHash returns the hash of secret that is stored with the link, the secret is random so a fast hash is sufficient
+func editSecretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// validEditSecret returns true if secret matches the edit secret of lnk
+func validEditSecret(lnk *Link, secret string) bool {
+	return lnk.EditHash != "" && secret != "" && subtle.ConstantTimeCompare([]byte(editSecretHash(secret)), []byte(lnk.EditHash)) == 1
+}
+
+// currentRevision returns the number of the revision in lnk.Data
+func currentRevision(lnk *Link) int {
+	if lnk.Revision == 0 {
+		return 1
+	}
+	return lnk.Revision
+}
+
+// revisable returns true if lnk is a text that can be revised, forked and diffed. Encrypted texts can not be diffed by the server and burn
+// after reading texts can only be read once
+func revisable(lnk *Link) bool {
+	return lnk.LinkType == "text" && !lnk.BurnAfterReading
+}
+
+// snapshot returns a copy of lnk taken while holding the lock of l, text links can be revised so their fields must not be read without the lock
+func (l *LinkLen) snapshot(lnk *Link) Link {
+	l.Mutex.RLock()
+	defer l.Mutex.RUnlock()
+	return *lnk
+}
+
+// revisionText returns the decompressed text of revision n of lnk, ok is false if the revision does not exist or has been removed
+func revisionText(lnk *Link, n int) (text string, ok bool) {
+	data, compressed := "", false
+	if n == currentRevision(lnk) {
+		data, compressed, ok = lnk.Data, lnk.IsCompressed, true
+	}
+	for _, rev := range lnk.Revisions {
+		if rev.N == n {
+			data, compressed, ok = rev.Data, rev.IsCompressed, true
+		}
+	}
+	if !ok {
+		return "", false
+	}
+	if compressed {
+		var err error
+		if data, err = decompress(data); err != nil { // defined in misc.go
+			return "", false
+		}
+	}
+	return data, true
+}
+
+// requestedRevision returns the revision selected with the rev query parameter, ok is false if no revision was requested. An invalid
+// number is returned as 0 which never exists
+func requestedRevision(r *http.Request, lnk *Link) (rev int, ok bool) {
+	value := r.URL.Query().Get("rev")
+	if value == "" {
+		return currentRevision(lnk), false
+	}
+	rev, _ = strconv.Atoi(value)
+	return rev, true
+}
+
+// revisionNumbers returns the numbers of all revisions of lnk that are still available, oldest first
+func revisionNumbers(lnk *Link) []int {
+	numbers := make([]int, 0, len(lnk.Revisions)+1)
+	for _, rev := range lnk.Revisions {
+		numbers = append(numbers, rev.N)
+	}
+	return append(numbers, currentRevision(lnk))
+}
+
+// compressText compresses text if it is large enough and gets smaller, the same rule is used for new texts
+func compressText(text string) (string, bool) {
+	if len(text) > minSizeToGzip {
+		compressed, err := compress(text)
+		if err == nil && len(text) > len(compressed) {
+			return compressed, true
+		}
+	}
+	return text, false
+}
+
+// reviseText adds the text in the form field text as a new revision of lnk if the request carries the edit secret of lnk. The previous
+// revision is kept in Revisions and the oldest revision is removed once there are more than MaxRevisions
+func reviseText(w http.ResponseWriter, r *http.Request, l *LinkLen, lnk *Link, key string) {
+	if r.Method != http.MethodPost {
+		logErrors(w, r, errInvalidRequest, http.StatusBadRequest, "")
+		return
+	}
+	if !allowRequest(w, r, getRateLimiters(r).Create, "Create") { // defined in ratelimit.go
+		return
+	}
+	if err := r.ParseMultipartForm(config.MaxFileSize); err != nil && err != http.ErrNotMultipart {
+		if strings.Contains(err.Error(), "request body too large") {
+			logErrors(w, r, errTooLarge, http.StatusRequestEntityTooLarge, "")
+			return
+		}
+		logErrors(w, r, errInvalidRequest, http.StatusBadRequest, "")
+		return
+	}
+	if !revisable(lnk) || maxRevisions() == 0 || lnk.EditHash == "" {
+		logErrors(w, r, errNotRevisable, http.StatusBadRequest, "")
+		return
+	}
+	secret := r.Header.Get(editSecretHeader)
+	if r.PostFormValue("secret") != "" {
+		secret = r.PostFormValue("secret")
+	}
+	if !validEditSecret(lnk, secret) {
+		logErrors(w, r, errWrongEditSecret, http.StatusForbidden, "")
+		return
+	}
+	text := r.PostFormValue("text")
+	if int64(len(text)) > config.MaxFileSize {
+		logErrors(w, r, errTooLarge, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	if lowRAM() {
+		logErrors(w, r, errLowRAM, http.StatusServiceUnavailable, "")
+		return
+	}
+	data, compressed := compressText(text)
+
+	l.Mutex.Lock()
+	if l.LinkMap[key] != lnk {
+		// the link timed out or was replaced while the text was compressed
+		l.Mutex.Unlock()
+		logErrors(w, r, errLinkExpired, http.StatusGone, "")
+		return
+	}
+	previous := Revision{N: currentRevision(lnk), Data: lnk.Data, IsCompressed: lnk.IsCompressed, Created: lnk.Updated}
+	revisions := append(append([]Revision{}, lnk.Revisions...), previous)
+	if len(revisions) > maxRevisions() {
+		revisions = revisions[len(revisions)-maxRevisions():]
+	}
+	// the fields are replaced and never modified in place so that a snapshot taken before stays consistent
+	lnk.Revisions = revisions
+	lnk.Revision = previous.N + 1
+	lnk.Data, lnk.IsCompressed = data, compressed
+	lnk.Updated = time.Now()
+	revision := lnk.Revision
+	l.Mutex.Unlock()
+	go saveLinkLenBackup(l) // defined in db.go
+
+	link := requestScheme(r) + "://" + r.Host + "/" + key
+	if writeCreated(w, r, createdResponse{URL: link, Expires: lnk.Timeout, Revision: revision}) { // defined in handlers.go
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		logOK(r, http.StatusSeeOther)
+		http.Redirect(w, r, "/"+key, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	logOK(r, http.StatusOK)
+	fmt.Fprintf(w, "%s\nrevision %d\n", link, revision)
+}
+
+// createdAt returns when the text lnk was created, texts from backups that were saved before Created was added use the time of their first
+// revision if it is known
+func createdAt(lnk *Link) time.Time {
+	switch {
+	case !lnk.Created.IsZero():
+		return lnk.Created
+	case lnk.Revision == 0:
+		return lnk.Updated
+	case len(lnk.Revisions) > 0 && lnk.Revisions[0].N == 1:
+		return lnk.Revisions[0].Created
+	}
+	return time.Time{}
+}
+
+// findParent returns a snapshot of the text on domain that lnk was forked from, goneMsg is set if the parent has been removed or its key
+// now belongs to another text
+func findParent(domain string, lnk *Link) (parent Link, goneMsg string) {
+	l, parentLnk, goneMsg := findLink(domain, lnk.Parent) // defined in handlers.go
+	if parentLnk == nil {
+		if goneMsg == "" {
+			goneMsg = errLinkExpired
+		}
+		return parent, goneMsg
+	}
+	parent = l.snapshot(parentLnk)
+	if lnk.ParentCreated.IsZero() || !createdAt(&parent).Equal(lnk.ParentCreated) {
+		return Link{}, errLinkExpired
+	}
+	return parent, ""
+}
+
+// lookupFork returns the text link on the domain of r that is forked with key, the Lookup and FailedLookup rate limits are applied the same
+// way as in handleGET so that keys can not be probed with /?fork= without limits. ok is false if the request has been answered
+func lookupFork(w http.ResponseWriter, r *http.Request, key string) (parent Link, ok bool) {
+	limiters := getRateLimiters(r) // defined in ratelimit.go
+	if !allowRequest(w, r, limiters.Lookup, "Lookup") {
+		return parent, false
+	}
+	if blocked, retryAfter := limiters.FailedLookup.Blocked(rateLimitKey(r)); blocked {
+		tooManyRequests(w, r, retryAfter, "FailedLookup")
+		return parent, false
+	}
+	parent, errMsg := forkParent(r.Host, key)
+	if errMsg == errKeyNotFound {
+		if allowed, retryAfter := limiters.FailedLookup.Allow(rateLimitKey(r)); !allowed {
+			tooManyRequests(w, r, retryAfter, "FailedLookup")
+			return parent, false
+		}
+	}
+	if errMsg != "" {
+		logErrors(w, r, errMsg, statusFor(errMsg), "")
+		return parent, false
+	}
+	return parent, true
+}
+
+// forkParent returns the text link on domain that a new text is forked from, an error message is returned if the key is not a text that can be forked
+func forkParent(domain, key string) (parent Link, errMsg string) {
+	if !validate(key) || strings.HasSuffix(key, "~") {
+		return parent, errInvalidKey
+	}
+	l, lnk, _ := findLink(domain, key) // defined in handlers.go
+	if lnk == nil {
+		return parent, errKeyNotFound
+	}
+	parent = l.snapshot(lnk)
+	if !revisable(&parent) || parent.PasswordHash != "" {
+		return parent, errNotForkable
+	}
+	return parent, ""
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindParent(t *testing.T) {
+	const domain = "parent.test"
+	lens := &LinkLens{}
+	for _, l := range []*LinkLen{&lens.LinkLen1, &lens.LinkLen2, &lens.LinkLen3, &lens.LinkCustom} {
+		l.LinkMap = make(map[string]*Link)
+		l.Domain = domain
+	}
+	domainLinkLens = map[string]*LinkLens{domain: lens}
+	defer func() { domainLinkLens = nil }()
+
+	created := time.Now().Add(-time.Hour)
+	parent := &Link{Key: "a", LinkType: "text", Data: "original", Updated: created, Created: created}
+	lens.LinkLen1.LinkMap["a"] = parent
+	fork := &Link{Key: "bc", LinkType: "text", Parent: "a", ParentRevision: 1, ParentCreated: created}
+
+	if got, goneMsg := findParent(domain, fork); goneMsg != "" || got.Data != "original" {
+		t.Fatalf("findParent() = %q, %q, want the parent", got.Data, goneMsg)
+	}
+
+	// a text from a backup without Created is identified by the time of its first revision
+	parent.Created = time.Time{}
+	if _, goneMsg := findParent(domain, fork); goneMsg != "" {
+		t.Fatalf("findParent() without Created = %q, want the parent", goneMsg)
+	}
+	parent.Revision = 2
+	parent.Updated = time.Now()
+	parent.Revisions = []Revision{{N: 1, Data: "first", Created: created}}
+	if _, goneMsg := findParent(domain, fork); goneMsg != "" {
+		t.Fatalf("findParent() of a revised parent = %q, want the parent", goneMsg)
+	}
+
+	// the key of the parent is reused by another text once the parent is removed
+	stranger := time.Now()
+	lens.LinkLen1.LinkMap["a"] = &Link{Key: "a", LinkType: "text", Data: "stranger", Updated: stranger, Created: stranger}
+	if got, goneMsg := findParent(domain, fork); goneMsg != errLinkExpired || got.Data != "" {
+		t.Errorf("findParent() after the key was reused = %q, %q, want %q", got.Data, goneMsg, errLinkExpired)
+	}
+
+	// forks without ParentCreated can not be verified
+	fork.ParentCreated = time.Time{}
+	if _, goneMsg := findParent(domain, fork); goneMsg != errLinkExpired {
+		t.Errorf("findParent() without ParentCreated = %q, want %q", goneMsg, errLinkExpired)
+	}
+
+	delete(lens.LinkLen1.LinkMap, "a")
+	fork.ParentCreated = created
+	if _, goneMsg := findParent(domain, fork); goneMsg != errLinkExpired {
+		t.Errorf("findParent() after the parent was removed = %q, want %q", goneMsg, errLinkExpired)
+	}
+}
@@ -4,19 +4,31 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"time"
-
-	"github.com/kr/pretty"
-	yaml "gopkg.in/yaml.v2"
 )
 
 func main() {
+	// handle subcommands, e.g. shorter check-config /path/to/config
+	if len(os.Args) >= 2 {
+		switch os.Args[1] {
+		case "check-config":
+			os.Exit(checkConfigCommand(os.Args[2:])) // defined in config.go
+		case "show-config":
+			os.Exit(showConfigCommand(os.Args[2:])) // defined in config.go
+		case "passwd":
+			os.Exit(passwdCommand(os.Args[2:])) // defined in credentials.go
+		case "paste":
+			os.Exit(pasteCommand(os.Args[2:])) // defined in encrypted.go
+		case "read":
+			os.Exit(readCommand(os.Args[2:])) // defined in encrypted.go
+		}
+	}
+
 	var conf []byte
 	var err error
 	// accept if we specify the path to the config directly without a flag, e.g. shorter /path/to/config
@@ -42,20 +54,18 @@ func main() {
 		}
 	}
 
-	// Populate the global config variable with the data from the config file
-	if err := yaml.UnmarshalStrict(conf, &config); err != nil {
-		log.Fatalln("Unable to parse config file:\n", err)
+	// Populate the global config variable with the data from the config file. Defined in config.go
+	config, err = parseConfig(conf)
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	// if BaseDir is not specified in the config search for a directory named shorterdata in the current directory and if not found search for a directory "src/github.com/7i/shorter/shorterdata" under all paths specified in GOPATH
-	if config.BaseDir == "" {
-		dataPath := findFolderDefaultLocations("shorterdata")
-		if dataPath != "" {
-			config.BaseDir = dataPath
-		} else {
-			log.Fatalln("Unable to locate a valid BaseDir, please specify BaseDir in the shorter config file")
-		}
+	// Refuse to start with an invalid config, the same checks are available with shorter check-config
+	if errs := validateConfig(&config); len(errs) > 0 {
+		printConfigErrors(os.Stderr, errs)
+		os.Exit(1)
 	}
+	// Create the directories for the backups of each domain. Defined in assets.go
+	initDomainDirs()
 
 	if config.Logging {
 		// logSep is set to a 128bit random string together with the configured config.LogSep string that is used as a log entry separator
@@ -69,6 +79,8 @@ func main() {
 			}
 		}
 		logSep = "[" + hex.EncodeToString(randomSep) + "-" + config.LogSep + "]"
+		// only the random part of the separator is shown in the header, LogSep is a secret
+		shownSep := "[" + hex.EncodeToString(randomSep) + "-" + redactedValue + "]"
 
 		var f *os.File
 		if config.Logfile != "" {
@@ -81,42 +93,68 @@ func main() {
 			logger = nil
 		} else {
 			defer f.Close()
-			// Write out server config on startup if logging is enabled
-			f.WriteString("Loaded config:\n" + fmt.Sprintf("%# v", pretty.Formatter(config)) + "\nLog Separator: " + logSep + "\n")
+			// Write out server config on startup if logging is enabled, secrets are redacted. Defined in config.go
+			f.WriteString("Loaded config:\n" + redactedConfig(config) + "Log Separator: " + shownSep + "\n")
 			logger = log.New(f, logSep+"\n", log.LstdFlags)
 		}
 	}
 
+	// Load the admin credentials. Defined in credentials.go
+	if err := loadCredentials(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Decode the keys for encryption at rest before the backups are restored. Defined in atrest.go
+	if err := initEncryption(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Parse the networks of the trusted reverse proxies. Defined in proxy.go
+	if err := initTrustedProxies(); err != nil {
+		log.Fatalln(err)
+	}
+
 	// init linkLen1, linkLen2, linkLen3 and fill each freeMap with all valid keys for each len. Defined in misc.go
 	initLinkLens()
 
-	// TODO: find better solution, maybe waitgroup so all TimeoutManager have started before starting the server
-	time.Sleep(time.Millisecond * 500)
+	// init the per client rate limiters for all domains. Defined in ratelimit.go
+	initRateLimiters()
 
+	// restore the saved links before starting the TimeoutManagers so that the restored links are cleared when they time out. Defined in db.go
 	setupDB()
+	startTimeoutManagers() // defined in misc.go
 	go BackupRoutine()
+	go persistenceCheckRoutine() // defined in health.go
 
-	// TODO: find better solution, maybe waitgroup
-	time.Sleep(time.Millisecond * 500)
-
+	initLocales() // defined in i18n.go
+	initThemes()  // defined in themes.go
 	initTemplates()
 
 	mux := http.NewServeMux()
 
-	handleCSS(mux)    // defined in handlers.go
+	handleCSS(mux)    // defined in themes.go
+	handleJS(mux)     // defined in themes.go
 	handleImages(mux) // defined in handlers.go
 	handleRobots(mux) // defined in handlers.go
 	handleRoot(mux)   // defined in handlers.go
+	handleHealth(mux) // defined in health.go
 
 	// Start server
 	if logger != nil {
 		logger.Println("Starting server")
 	}
-	// if NoTLS is set only start a http server
-	if config.NoTLS {
-		log.Fatalln(http.ListenAndServe(config.AddressPort, mux))
+	for _, warning := range checkHSTSPreload() { // defined in letsencrypt.go
+		log.Println("Warning:", warning)
+		if logger != nil {
+			logger.Println("Warning:", warning)
+		}
+	}
+	listeners, err := openListeners() // defined in listeners.go
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := startNetcat(); err != nil { // defined in netcat.go
+		log.Fatalln(err)
 	}
-	server := getServer(mux) // defined in letsencrypt.go
-	// Using LetsEncrypt, no premade cert and key files needed
-	log.Fatalln(server.ListenAndServeTLS("", ""))
+	serve(mux, listeners) // defined in listeners.go
 }
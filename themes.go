@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"reflect"
+	texttemplate "text/template"
+	"time"
+)
+
+// partialNames contains the templates that are parsed together with every page, a page can use them with {{template "layout" .}} and
+// define the "content" block, a theme can override each of them separately
+var partialNames = []string{"layout.tmpl", "partials/head.tmpl", "partials/header.tmpl", "partials/tos.tmpl", "partials/footer.tmpl"}
+
+var (
+	// defaultThemeVars contains the values used for all ThemeVars fields that are not set in the config
+	defaultThemeVars = ThemeVars{
+		SiteName:    "Temp Url shortener",
+		Title:       "Temporary URL shortener",
+		Description: "Simple temporary URL shortener. Also supports temporary text blobs. 1-3 chars long or custom words.",
+		Notice:      "Pre Alpha test site, links will be cleared during development without notice.",
+		Colors: ThemeColors{
+			Primary:    "#209cee",
+			Background: "#fafafa",
+			Surface:    "#fff",
+			Text:       "#000",
+			Error:      "#C00000",
+		},
+	}
+	// sites contains the theme variables for each domain, should be used as read only after initThemes() has returned
+	sites map[string]*siteVars
+)
+
+// siteVars are the theme variables of a domain that are available to all templates as .Site and to the css
+type siteVars struct {
+	ThemeVars
+	// Theme is the name of the selected theme, empty for the built-in theme
+	Theme string
+	// Timeouts contains the configured lifetime of each kind of link
+	Timeouts struct {
+		Len1, Len2, Len3, Custom time.Duration
+	}
+	// CSSIntegrity is the subresource integrity hash of the rendered shorter.css
+	CSSIntegrity string
+	// css is the rendered shorter.css
+	css []byte
+	// JSIntegrity is the subresource integrity hash of paste.js
+	JSIntegrity string
+	// js is paste.js which encrypts and decrypts encrypted pastes, defined in encrypted.go
+	js []byte
+}
+
+// ToSHTML returns the configured ToS without escaping since it is set by the operator in the config
+func (s *siteVars) ToSHTML() template.HTML {
+	return template.HTML(s.ToS)
+}
+
+// templateFuncs are available in all templates and the css
+var templateFuncs = map[string]interface{}{
+	"duration": formatDuration,
+	"date":     formatDate,
+}
+
+// formatDuration formats d as short as possible in the style used on the index page, e.g. 24h, 7d or 30m
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour && d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
+
+// formatDate formats t with dateFormat
+func formatDate(t time.Time) string {
+	return t.Format(dateFormat)
+}
+
+// themeFor returns the theme selected for domain
+func themeFor(domain string) string {
+	if dc, ok := config.Domains[domain]; ok && dc.Theme != "" {
+		return dc.Theme
+	}
+	return config.Theme
+}
+
+// mergeThemeVars sets all empty string fields of dst to the value of the same field in src, nested structs are merged recursively
+func mergeThemeVars(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		switch dst.Field(i).Kind() {
+		case reflect.String:
+			if dst.Field(i).String() == "" {
+				dst.Field(i).SetString(src.Field(i).String())
+			}
+		case reflect.Struct:
+			mergeThemeVars(dst.Field(i), src.Field(i))
+		}
+	}
+}
+
+// initThemes builds the theme variables and renders shorter.css for every domain, the css is rendered as a text/template with the theme variables
+func initThemes() {
+	sites = make(map[string]*siteVars)
+	for _, domain := range config.DomainNames {
+		site := &siteVars{Theme: themeFor(domain)}
+		site.ThemeVars = config.Domains[domain].ThemeVars
+		mergeThemeVars(reflect.ValueOf(&site.ThemeVars).Elem(), reflect.ValueOf(config.ThemeVars))
+		mergeThemeVars(reflect.ValueOf(&site.ThemeVars).Elem(), reflect.ValueOf(defaultThemeVars))
+		if site.Notice == "-" {
+			site.Notice = ""
+		}
+		site.Timeouts.Len1 = config.Clear1Duration
+		site.Timeouts.Len2 = config.Clear2Duration
+		site.Timeouts.Len3 = config.Clear3Duration
+		site.Timeouts.Custom = config.ClearCustomLinksDuration
+
+		data, source, err := readAsset(domain, "css/shorter.css") // defined in assets.go
+		if err != nil {
+			log.Fatalln("Unable to read "+source+":", err)
+		}
+		tmpl, err := texttemplate.New("shorter.css").Funcs(templateFuncs).Parse(string(data))
+		if err != nil {
+			log.Fatalln("Unable to parse "+source+":", err)
+		}
+		var css bytes.Buffer
+		if err := tmpl.Execute(&css, site); err != nil {
+			log.Fatalln("Unable to render "+source+":", err)
+		}
+		site.css = css.Bytes()
+		sum := sha256.Sum256(site.css)
+		site.CSSIntegrity = "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+		if logger != nil {
+			logger.Println("Loaded /" + domain + "/shorter.css from " + source)
+		}
+
+		if site.js, source, err = readAsset(domain, "js/paste.js"); err != nil {
+			log.Fatalln("Unable to read "+source+":", err)
+		}
+		sum = sha256.Sum256(site.js)
+		site.JSIntegrity = "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+		sites[domain] = site
+	}
+}
+
+// parsePage parses the page templateName.tmpl for domain together with the layout and all partials. The partials are parsed first so that
+// the blocks defined by the page replace the default blocks of the layout
+func parsePage(domain, templateName string) (*template.Template, error) {
+	tmpl := template.New(templateName + ".tmpl").Funcs(templateFuncs)
+	for _, name := range partialNames {
+		data, source, err := readAsset(domain, name) // defined in assets.go
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", source, err)
+		}
+		if _, err := tmpl.New(name).Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", source, err)
+		}
+	}
+	data, source, err := readAsset(domain, templateName+".tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", source, err)
+	}
+	if _, err := tmpl.Parse(string(data)); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", source, err)
+	}
+	if logger != nil {
+		logger.Println("Template key value: ", domain+"#"+templateName, "loaded from", source)
+	}
+	return tmpl, nil
+}
+
+// newShowLinkVars returns the template variables for showLink.tmpl
+func newShowLinkVars(r *http.Request, scheme, data string, timeout time.Time) showLinkVars {
+	l := getLocalizer(r) // defined in i18n.go
+	return showLinkVars{Domain: scheme + "://" + r.Host, Data: data, Timeout: l.Date(timeout), Expires: timeout, Site: sites[r.Host], L: l}
+}
+
+// handleCSS adds /shorter.css to all domains specified in config, the css is rendered with the theme variables of the requested domain in initThemes
+func handleCSS(mux *http.ServeMux) {
+	handlers := make(map[string]func(w http.ResponseWriter, r *http.Request))
+	for domain, site := range sites {
+		handlers[domain] = getSingleFileHandler(site.css, "text/css") // defined in handlers.go
+	}
+	mux.HandleFunc("/shorter.css", func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := handlers[r.Host]; ok {
+			handler(w, r)
+			return
+		}
+		addHeaders(w, r)
+		http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
+	})
+}
+
+// handleJS adds /paste.js to all domains specified in config, the script is only served from its own file so that the CSP can allow it by url
+func handleJS(mux *http.ServeMux) {
+	handlers := make(map[string]func(w http.ResponseWriter, r *http.Request))
+	for domain, site := range sites {
+		handlers[domain] = getSingleFileHandler(site.js, "text/javascript") // defined in handlers.go
+	}
+	mux.HandleFunc("/paste.js", func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := handlers[r.Host]; ok {
+			handler(w, r)
+			return
+		}
+		addHeaders(w, r)
+		http.Error(w, localize(r, errServerError), http.StatusInternalServerError)
+	})
+}
@@ -10,9 +10,10 @@ import (
 	"time"
 )
 
-// Config contains all valid fields from a shorter config file
+// Config contains all valid fields from a shorter config file, every field can be overridden with a SHORTER_ environment variable, see applyEnvOverrides.
+// Fields tagged with secret:"true" are redacted when the config is shown or logged
 type Config struct {
-	// BaseDir specifies the path to the base directory to search for resources for the shorter service
+	// BaseDir specifies the directory for backups and logs, files in BaseDir and BaseDir/<domain> override the built-in theme. Defaults to ./shorterdata
 	BaseDir string `yaml:"BaseDir"`
 	// CertDir specifies the path to the directory that shorter will use to cache the LetsEnctypt certs
 	CertDir string `yaml:"CertDir"`
@@ -21,13 +22,18 @@ type Config struct {
 	// Logfile specifies the file to write logs to, If Logfile is not specified BaseDir/shorter.log is used
 	Logfile string `yaml:"Logfile"`
 	//LogSep is a secret log separator value to make it harder to forge log entry's
-	LogSep string `yaml:"LogSep"`
+	LogSep string `yaml:"LogSep" secret:"true"`
+	// LogSepFile specifies a file to read LogSep from, e.g. a docker or kubernetes secret
+	LogSepFile string `yaml:"LogSepFile"`
 	// DomainName should be the domain name of the instance of shorter, e.g. 7i.se
 	DomainNames []string `yaml:"DomainNames"`
 	// NoTLS specifies if we should inactivate TLS and only use unencrypted HTTP
 	NoTLS bool `yaml:"NoTLS"`
-	// AddressPort specifies the address and port the shorter service should listen on
+	// AddressPort specifies the address and port the shorter service should listen on.
+	// If NoTLS is false AddressPort answers ACME "http-01" challenges and redirects all other requests for DomainNames to https
 	AddressPort string `yaml:"AddressPort"`
+	// NoHTTPRedirect specifies that requests to AddressPort that are not ACME challenges should get 404 instead of a redirect to https, only used if NoTLS is false
+	NoHTTPRedirect bool `yaml:"NoHTTPRedirect"`
 	// TLSAddressPort specifies the address and port the shorter service should listen to HTTPS connections on
 	TLSAddressPort string `yaml:"TLSAddressPort"`
 	// Clear1Duration should specify the time between clearing old 1 character long URLs.
@@ -39,43 +45,260 @@ type Config struct {
 	Clear3Duration time.Duration `yaml:"Clear3Duration"`
 	// ClearCustomLinksDuration, same as Clear1Duration bur for custom URLs
 	ClearCustomLinksDuration time.Duration `yaml:"ClearCustomLinksDuration"`
+	// RememberExpiredDuration specifies how long the keys of expired links are remembered so that users are told that a link has expired
+	// instead of that it does not exist. Defaults to 24h, a negative value disables it
+	RememberExpiredDuration time.Duration `yaml:"RememberExpiredDuration"`
 	// MaxCustomLinks, sets the maximum number of active CustomLinks before reporting that all are used up
 	MaxCustomLinks int `yaml:"MaxCustomLinks"`
 	// Max file size when parsing POST form data
 	MaxFileSize int64 `yaml:"MaxFileSize"`
 	// MaxDiskUsage specifies how much space in total shorter is allowed to save on disk
 	MaxDiskUsage int64 `yaml:"MaxDiskUsage"`
-	// LinkAccessMaxNr specifies how many times a link is allowed to be accessed if xTimes is specified in the request
+	// LinkAccessMaxNr is the highest xTimes that is accepted, higher values are lowered to it. If not set xTimes is not limited
 	LinkAccessMaxNr int `yaml:"LinkAccessMaxNr"`
-	// MaxRam sets the maximum RAM usage that shorter is allowed to use before returning 500 errLowRAM errors to new requests
+	// MaxRam sets the maximum RAM usage that shorter is allowed to use before returning 503 errLowRAM errors to new requests
 	MaxRAM uint64 `yaml:"MaxRAM"`
 	// Email optionally specifies a contact email address.
 	// This is used by CAs, such as Let's Encrypt, to notify about problems with issued certificates.
 	// If the Client's account key is already registered, Email is not used.
 	Email string `yaml:"Email"`
+	// UnlockMaxAttempts is the number of wrong passwords after which a password protected link is locked for UnlockLockout. Defaults to 5
+	UnlockMaxAttempts int `yaml:"UnlockMaxAttempts"`
+	// UnlockLockout is how long a password protected link is locked after UnlockMaxAttempts wrong passwords. Defaults to 15m
+	UnlockLockout time.Duration `yaml:"UnlockLockout"`
+	// RedirectMode specifies how url links are answered, "direct" answers with an HTTP redirect, "interstitial" shows the target of the link
+	// and "countdown" shows the target and forwards after CountdownSeconds. Links flagged as suspicious always show the target and a warning.
+	// Defaults to "interstitial", each link can override it when it is created
+	RedirectMode string `yaml:"RedirectMode"`
+	// RedirectStatus is the status code of direct redirects, 302 or 307. Defaults to 302
+	RedirectStatus int `yaml:"RedirectStatus"`
+	// CountdownSeconds is the number of seconds the countdown page is shown before forwarding. Defaults to 5
+	CountdownSeconds int `yaml:"CountdownSeconds"`
+	// MaxRevisions is the number of older revisions that are kept for each text, the oldest revision is removed when a new one is added.
+	// Defaults to 10, a negative value disables revisions
+	MaxRevisions int `yaml:"MaxRevisions"`
 	// StaticLinks contains a list of static keys that will no time out
 	StaticLinks map[string]string `yaml:"StaticLinks"`
-	// Salt is used as the Salt for the password for special requests
-	Salt string `yaml:"Salt"`
-	// HashSHA256 is the sha256 hash of the password and Salt used for special requests
-	HashSHA256 string `yaml:"HashSHA256"`
+	// Salt is used as the Salt for the password for special requests, deprecated in favour of CredentialsFile
+	Salt string `yaml:"Salt" secret:"true"`
+	// SaltFile specifies a file to read Salt from
+	SaltFile string `yaml:"SaltFile"`
+	// HashSHA256 is the sha256 hash of the password and Salt used for special requests, deprecated in favour of CredentialsFile
+	HashSHA256 string `yaml:"HashSHA256" secret:"true"`
+	// HashSHA256File specifies a file to read HashSHA256 from
+	HashSHA256File string `yaml:"HashSHA256File"`
+	// EncryptionKey enables encryption at rest of the backups, it is a base64 encoded 32 byte master key. Every domain uses its own key that is
+	// derived from EncryptionKey. If not set the backups are written as plaintext
+	EncryptionKey string `yaml:"EncryptionKey" secret:"true"`
+	// EncryptionKeyFile specifies a file to read EncryptionKey from
+	EncryptionKeyFile string `yaml:"EncryptionKeyFile"`
+	// EncryptionPreviousKeys is a comma separated list of keys that were used as EncryptionKey before, backups encrypted with them are
+	// decrypted on startup and re-encrypted with EncryptionKey in the background
+	EncryptionPreviousKeys string `yaml:"EncryptionPreviousKeys" secret:"true"`
+	// EncryptionPreviousKeysFile specifies a file to read EncryptionPreviousKeys from, one key per line
+	EncryptionPreviousKeysFile string `yaml:"EncryptionPreviousKeysFile"`
+	// CredentialsFile specifies a file with named admin credentials and their roles, use shorter passwd to create and update it
+	CredentialsFile string `yaml:"CredentialsFile"`
 	// CSP controls if a Content-Security-Policy should be included in all requests to shorter, if not set no Content-Security-Policy header is used
 	CSP string `yaml:"CSP"`
 	// HSTS controls if a Strict-Transport-Security header should be included in all requests to shorter. Can only be used if NoTLS is set to false. If not set then no Strict-Transport-Security header will be included
 	HSTS string `yaml:"HSTS"`
 	// ReportTo controls if a Report-To header should be included in all requests to shorter, if not set no Report-To header is used
 	ReportTo string `yaml:"ReportTo"`
+	// ACMEDirectoryURL specifies the directory of the ACME CA, e.g. an internal step-ca or a local pebble instance. If not set Let's Encrypt is used
+	ACMEDirectoryURL string `yaml:"ACMEDirectoryURL"`
+	// ACMEStaging specifies if the Let's Encrypt staging environment should be used, ignored if ACMEDirectoryURL is set
+	ACMEStaging bool `yaml:"ACMEStaging"`
+	// ACMERootCAFile optionally specifies a PEM file with the root certificates that are trusted when connecting to the ACME directory
+	ACMERootCAFile string `yaml:"ACMERootCAFile"`
+	// ACMEEABKeyID is the key identifier for External Account Binding, required by some private CAs
+	ACMEEABKeyID string `yaml:"ACMEEABKeyID"`
+	// ACMEEABHMACKey is the base64url encoded HMAC key for External Account Binding
+	ACMEEABHMACKey string `yaml:"ACMEEABHMACKey" secret:"true"`
+	// ACMEEABHMACKeyFile specifies a file to read ACMEEABHMACKey from
+	ACMEEABHMACKeyFile string `yaml:"ACMEEABHMACKeyFile"`
+	// Listeners replaces AddressPort and TLSAddressPort with any number of TCP, unix socket or systemd socket activation listeners
+	Listeners []ListenerConfig `yaml:"Listeners"`
+	// Netcat configures the optional raw TCP listener for texts, e.g. echo hi | nc 7i.se 9999, defined in netcat.go
+	Netcat NetcatConfig `yaml:"Netcat"`
+	// TLSProfile selects the TLS versions, cipher suites and curves, either "modern" (TLS 1.3 only) or "intermediate" (TLS 1.2 and 1.3). Defaults to intermediate
+	TLSProfile string `yaml:"TLSProfile"`
+	// DisableHTTP2 disables HTTP/2 so that only HTTP/1.1 is used
+	DisableHTTP2 bool `yaml:"DisableHTTP2"`
+	// H2C enables HTTP/2 without TLS on AddressPort, only used if NoTLS is set. Useful behind a TLS terminating proxy that uses HTTP/2 to its backends
+	H2C bool `yaml:"H2C"`
+	// Certificates contains PEM encoded certificate and key pairs that are used instead of Let's Encrypt for the domains they cover.
+	// Domains in DomainNames that are not covered by any static certificate will use ACME.
+	Certificates []CertificateConfig `yaml:"Certificates"`
+	// TrustedProxies contains the CIDR networks or single IP addresses of reverse proxies that are trusted to report the client IP and scheme
+	// with the X-Forwarded-For, X-Forwarded-Proto and Forwarded headers. Forwarding headers from all other peers are ignored.
+	// If any TrustedProxies are set peers connected to a unix socket listener are also trusted.
+	TrustedProxies []string `yaml:"TrustedProxies"`
+	// ProxyProtocol specifies if connections from TrustedProxies must start with a PROXY protocol v1 or v2 header containing the client address
+	ProxyProtocol bool `yaml:"ProxyProtocol"`
+	// RateLimits specifies the per client request budgets for all domains that do not override them in Domains
+	RateLimits RateLimits `yaml:"RateLimits"`
+	// Theme selects the theme for all domains that do not override it in Domains, custom themes are loaded from BaseDir/themes/<Theme>. Defaults to the built-in theme
+	Theme string `yaml:"Theme"`
+	// ThemeVars contains the variables that are available to the templates and css of all domains, see ThemeVars for the default values
+	ThemeVars ThemeVars `yaml:"ThemeVars"`
+	// Language is the BCP 47 tag of the language used when no language in the Accept-Language header of a request is supported, e.g. "sv". Defaults to "en"
+	Language string `yaml:"Language"`
+	// TimeZone is the IANA time zone used for dates shown to users, e.g. "Europe/Stockholm". Defaults to the time zone of the server
+	TimeZone string `yaml:"TimeZone"`
+	// Domains contains optional per domain settings, the key is the domain name as specified in DomainNames
+	Domains map[string]DomainConfig `yaml:"Domains"`
+}
+
+// ListenerConfig specifies a single socket that shorter should accept connections on
+type ListenerConfig struct {
+	// Network is one of "tcp", "tcp4", "tcp6", "unix" or "systemd", defaults to "tcp"
+	Network string `yaml:"Network"`
+	// Address is the address and port for tcp, the socket path for unix and the optional FileDescriptorName for systemd,
+	// if no name is specified for systemd the first socket that is not used by another listener is used
+	Address string `yaml:"Address"`
+	// Serve is one of "http" for plain HTTP, "https" for TLS or "redirect" for ACME challenges and redirects to https, defaults to "http"
+	Serve string `yaml:"Serve"`
+	// SocketMode optionally sets the permissions of a unix socket in octal notation, e.g. "0660"
+	SocketMode string `yaml:"SocketMode"`
+	// SocketGroup optionally sets the group name or id of a unix socket
+	SocketGroup string `yaml:"SocketGroup"`
+}
+
+// NetcatConfig configures the raw TCP listener where the text sent on a connection is added as a text link and the link is written back
+type NetcatConfig struct {
+	// Address is the address and port to listen on, e.g. ":9999". The listener is disabled if Address is not set
+	Address string `yaml:"Address"`
+	// Domain is the domain in DomainNames the texts are added to, defaults to the first domain in DomainNames
+	Domain string `yaml:"Domain"`
+	// IdleTimeout ends the text when the client has not sent anything for this long, since nc does not always close its side of the
+	// connection after the input ends. Defaults to 2s
+	IdleTimeout time.Duration `yaml:"IdleTimeout"`
+	// ReadTimeout is the longest time a client can take to send the whole text. Defaults to 30s
+	ReadTimeout time.Duration `yaml:"ReadTimeout"`
+	// MaxConnections limits the number of connections that are read at the same time, further connections wait. Defaults to 64
+	MaxConnections int `yaml:"MaxConnections"`
+}
+
+// CertificateConfig specifies a static certificate, the files are reloaded automatically when they change on disk
+type CertificateConfig struct {
+	// Domains contains the host names the certificate should be used for, if not set the DNS names in the certificate are used
+	Domains []string `yaml:"Domains"`
+	// CertFile is the path to the PEM encoded certificate chain
+	CertFile string `yaml:"CertFile"`
+	// KeyFile is the path to the PEM encoded private key
+	KeyFile string `yaml:"KeyFile"`
+}
+
+// DomainConfig contains settings that can be overridden for a single domain
+type DomainConfig struct {
+	// RateLimits replaces the global RateLimits for the domain if set
+	RateLimits *RateLimits `yaml:"RateLimits"`
+	// RedirectMode replaces the global RedirectMode for the domain if set
+	RedirectMode string `yaml:"RedirectMode"`
+	// RedirectStatus replaces the global RedirectStatus for the domain if set
+	RedirectStatus int `yaml:"RedirectStatus"`
+	// CountdownSeconds replaces the global CountdownSeconds for the domain if set
+	CountdownSeconds int `yaml:"CountdownSeconds"`
+	// Theme replaces the global Theme for the domain if set
+	Theme string `yaml:"Theme"`
+	// ThemeVars overrides the fields of the global ThemeVars that are set
+	ThemeVars ThemeVars `yaml:"ThemeVars"`
+	// Language replaces the global Language for the domain if set
+	Language string `yaml:"Language"`
+	// TimeZone replaces the global TimeZone for the domain if set
+	TimeZone string `yaml:"TimeZone"`
+}
+
+// ThemeVars contains the variables of a theme, fields that are not set use the value from the global ThemeVars and then the built-in default
+type ThemeVars struct {
+	// SiteName is shown in the header of all pages
+	SiteName string `yaml:"SiteName"`
+	// Title is the title of the index page
+	Title string `yaml:"Title"`
+	// Description is used for the description meta tag
+	Description string `yaml:"Description"`
+	// Notice is shown below the form on the index page, set it to "-" to hide the notice
+	Notice string `yaml:"Notice"`
+	// ToS replaces the Terms of Service text, HTML is allowed
+	ToS string `yaml:"ToS"`
+	// Colors are used by the css of the built-in theme
+	Colors ThemeColors `yaml:"Colors"`
+}
+
+// ThemeColors contains the css colors of a theme
+type ThemeColors struct {
+	Primary    string `yaml:"Primary"`
+	Background string `yaml:"Background"`
+	Surface    string `yaml:"Surface"`
+	Text       string `yaml:"Text"`
+	Error      string `yaml:"Error"`
+}
+
+// RateLimits contains the separate per client budgets for the different kinds of requests
+type RateLimits struct {
+	// Create limits the creation of new links and text blobs
+	Create RateLimit `yaml:"Create"`
+	// Lookup limits requests for existing keys
+	Lookup RateLimit `yaml:"Lookup"`
+	// FailedLookup limits requests for keys that do not exist, this makes it harder to enumerate active keys
+	FailedLookup RateLimit `yaml:"FailedLookup"`
+	// AdminLogin limits password attempts for special requests. Defaults to 30 per hour with a burst of 10, it can not be disabled
+	AdminLogin RateLimit `yaml:"AdminLogin"`
+}
+
+// RateLimit describes a token bucket that is refilled with Rate tokens every Per and holds at most Burst tokens.
+// If Rate is 0 no limit is applied.
+type RateLimit struct {
+	Rate  int           `yaml:"Rate"`
+	Per   time.Duration `yaml:"Per"`
+	Burst int           `yaml:"Burst"`
 }
 
 // link tracks the contents and lifetime of a link.
 type Link struct {
-	Key          string    `json:"Key"`
-	LinkType     string    `json:"LinkType"`
-	Data         string    `json:"Data"`
-	IsCompressed bool      `json:"IsCompressed"`
-	Times        int       `json:"Times"`
+	Key          string `json:"Key"`
+	LinkType     string `json:"LinkType"`
+	Data         string `json:"Data"`
+	IsCompressed bool   `json:"IsCompressed"`
+	Times        int    `json:"Times"`
+	// Redirect is the redirect mode of a url link, one of "direct", "interstitial" or "countdown". If empty the mode of the domain is used
+	Redirect string `json:"Redirect,omitempty"`
+	// Prefix specifies if the path and query after the key are appended to Data, so that the key acts as a mount point for a whole site
+	Prefix bool `json:"Prefix,omitempty"`
+	// BurnAfterReading specifies if a text link is removed the first time it is revealed, a GET request only shows the reveal page
+	BurnAfterReading bool `json:"BurnAfterReading,omitempty"`
+	// Language is the language a text link is highlighted as in the paste view, if empty the language is detected from the text
+	Language string `json:"Language,omitempty"`
+	// EditHash is the sha256 hash of the edit secret that is issued when a text is created, the secret is required to add revisions
+	EditHash string `json:"EditHash,omitempty"`
+	// Revision is the number of the revision in Data, 0 for texts that were never revised. Older revisions are kept in Revisions
+	Revision  int        `json:"Revision,omitempty"`
+	Revisions []Revision `json:"Revisions,omitempty"`
+	// Updated is when the revision in Data was created
+	Updated time.Time `json:"Updated,omitempty"`
+	// Created is when the text was created, it identifies the text together with the key since keys are reused once a link is removed
+	Created time.Time `json:"Created,omitempty"`
+	// Parent and ParentRevision are the key and revision the text was forked from, empty if it is not a fork. ParentCreated is the creation
+	// time of the parent, another text that is added with the same key after the parent was removed is not the parent
+	Parent         string    `json:"Parent,omitempty"`
+	ParentRevision int       `json:"ParentRevision,omitempty"`
+	ParentCreated  time.Time `json:"ParentCreated,omitempty"`
+	// PasswordHash is the argon2id hash of the optional password that is required to access the link
+	PasswordHash string    `json:"PasswordHash,omitempty"`
 	Timeout      time.Time `json:"Timeout"`
 	NextClear    *Link     `json:"NextClear"`
+	// failedUnlocks and lockedUntil count wrong passwords, they are unexported so that they are not saved in backups
+	failedUnlocks int
+	lockedUntil   time.Time
+}
+
+// Revision is an older revision of a text link, N is the number of the revision starting at 1
+type Revision struct {
+	N            int       `json:"N"`
+	Data         string    `json:"Data"`
+	IsCompressed bool      `json:"IsCompressed"`
+	Created      time.Time `json:"Created"`
 }
 
 type LinkLen struct {
@@ -87,6 +310,18 @@ type LinkLen struct {
 	EndClear  *Link            `json:"EndClear"`  // last element in linked list
 	Timeout   time.Duration    `json:"Timeout"`
 	Domain    string           `json:"Domain"`
+	// Gone contains the keys of links that were removed recently, it is not saved in backups
+	Gone map[string]goneLink `json:"-"`
+	// backupMutex is held by saveBackup from the snapshot until the file is written so that an older snapshot never replaces a newer one
+	backupMutex sync.Mutex
+}
+
+// goneLink remembers why a key was removed
+type goneLink struct {
+	// Since is the time the link was removed
+	Since time.Time
+	// Message is the user facing error message for the key, e.g. errLinkExpired
+	Message string
 }
 
 type LinkLens struct {
@@ -96,10 +331,32 @@ type LinkLens struct {
 	LinkCustom LinkLen `json:"LinkCustom"`
 }
 
+// showLinkVars are the template variables of showLink.tmpl
 type showLinkVars struct {
-	Domain  string `json:"Domain"`
-	Data    string `json:"Data"`
-	Timeout string `json:"Timeout"`
+	Domain  string     `json:"Domain"`
+	Data    string     `json:"Data"`
+	Timeout string     `json:"Timeout"`
+	Expires time.Time  `json:"Expires"`
+	Site    *siteVars  `json:"-"`
+	L       *localizer `json:"-"`
+	// Countdown is the number of seconds before the browser is forwarded to Data, 0 disables forwarding
+	Countdown int `json:"Countdown"`
+	// Reasons contains the reasons why the link is flagged as suspicious, the trust warning is shown if it is not empty
+	Reasons []string `json:"Reasons"`
+	// EditSecret is shown once after a text is created, it is required to add revisions
+	EditSecret string `json:"-"`
+}
+
+// indexVars are the template variables of index.tmpl
+type indexVars struct {
+	Domain string
+	// Languages are the options of the language select for texts, defined in highlight.go
+	Languages []languageOption
+	// Fork is the key of the text that is forked and ForkText its text, defined in revisions.go
+	Fork     string
+	ForkText string
+	Site     *siteVars
+	L        *localizer
 }
 
 // Add adds the value lnk with a new key if no key is provided to linkMap and removes the same key from freeMap if freeMap is used and returns the key used or an error, note that the error should be useful for the user while not leak server information
@@ -117,9 +374,20 @@ func (l *LinkLen) Add(lnk *Link) (key string, err error) {
 	// check if lnk is a custom link, FreeMap is nill for custom links
 	isCustomLink := false
 	if l.FreeMap == nil {
+		if reservedKeys[lnk.Key] {
+			if logger != nil {
+				logger.Println("AddKey: invalid parameter key, key is reserved: " + url.QueryEscape(lnk.Key))
+			}
+			return "", errors.New(errInvalidKeyReserved)
+		}
 		if len(lnk.Key) < 4 || len(lnk.Key) >= maxKeyLen || !validate(lnk.Key) {
-			logger.Println("AddKey: invalid parameter key, key can only be > 4 or < " + strconv.Itoa(maxKeyLen))
-			return "", errors.New("Error: key can only be of length > 4 and < " + strconv.Itoa(maxKeyLen) + " and only use the following characters:\n" + customKeyCharset)
+			if logger != nil {
+				logger.Println("AddKey: invalid parameter key, key can only be > 4 or < " + strconv.Itoa(maxKeyLen))
+			}
+			return "", errors.New(errInvalidCustomKey)
+		}
+		if _, used := l.LinkMap[lnk.Key]; used {
+			return "", errors.New(errInvalidKeyUsed)
 		}
 		isCustomLink = true
 		key = lnk.Key
@@ -155,11 +423,7 @@ func (l *LinkLen) Add(lnk *Link) (key string, err error) {
 		if logger != nil {
 			logger.Println("Error: No keys left")
 		}
-		if isCustomLink {
-			return "", errors.New("No custom links left")
-		} else {
-			return "", errors.New("No keys left for key length " + strconv.Itoa(len(l.EndClear.Key)))
-		}
+		return "", errors.New(errNoKeysLeft)
 	}
 
 	if time.Since(lnk.Timeout) > 0 {
@@ -199,6 +463,7 @@ func (l *LinkLen) Add(lnk *Link) (key string, err error) {
 	}
 	l.EndClear = lnk
 	l.LinkMap[key] = lnk
+	delete(l.Gone, key)
 	if isCustomLink {
 		l.Links++
 	} else {
@@ -211,8 +476,69 @@ func (l *LinkLen) Add(lnk *Link) (key string, err error) {
 	return key, nil
 }
 
+// Remove removes the link with key from l before it times out and returns it, the key is returned to l.FreeMap and remembered with the
+// user facing message msg. ok is false if no link with key exists, so only one of several concurrent callers gets the link
+func (l *LinkLen) Remove(key, msg string) (lnk *Link, ok bool) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if lnk, ok = l.LinkMap[key]; !ok {
+		return nil, false
+	}
+
+	// unlink lnk from the list of links ordered by timeout, the TimeoutManager picks up the new l.NextClear on its next tick
+	var prev *Link
+	for next := l.NextClear; next != nil && next != lnk; next = next.NextClear {
+		prev = next
+	}
+	if prev == nil {
+		l.NextClear = lnk.NextClear
+	} else {
+		prev.NextClear = lnk.NextClear
+	}
+	if l.EndClear == lnk {
+		l.EndClear = prev
+	}
+	lnk.NextClear = nil
+
+	delete(l.LinkMap, key)
+	if l.FreeMap != nil {
+		l.FreeMap[key] = true
+	} else {
+		l.Links--
+	}
+	l.rememberGone(key, msg)
+	if logger != nil {
+		logger.Println("Removed key", url.QueryEscape(key), "of length", len(key), "on", l.Domain)
+	}
+	return lnk, true
+}
+
+// countRead counts a read of lnk with key if it was created with xTimes, the last allowed read removes the link and removed is set so that
+// the caller saves a backup. ok is false if the link has already been removed, e.g. by a concurrent last read
+func (l *LinkLen) countRead(key string, lnk *Link) (ok, removed bool) {
+	l.Mutex.Lock()
+	switch {
+	case l.LinkMap[key] != lnk:
+		l.Mutex.Unlock()
+		return false, false
+	case lnk.Times <= 0:
+		// -1 represents no limit
+		l.Mutex.Unlock()
+		return true, false
+	case lnk.Times > 1:
+		lnk.Times--
+		l.Mutex.Unlock()
+		return true, false
+	}
+	l.Mutex.Unlock()
+	// only one of several concurrent last reads removes the link
+	_, ok = l.Remove(key, errLinkExpired)
+	return ok, ok
+}
+
 // TimeoutHandler removes links from its linkMap when the links have timed out. Start TimeoutHandler in a separate gorutine and only start one TimeoutHandler() per linkLen.
-func (l *LinkLen) TimeoutManager() {
+// started.Done() is called once the TimeoutManager is running.
+func (l *LinkLen) TimeoutManager(started *sync.WaitGroup) {
 	if logger != nil {
 		logger.Println("TimeoutHandler started for", len(l.FreeMap)+len(l.LinkMap), "keys on domain", l.Domain)
 	}
@@ -220,10 +546,12 @@ func (l *LinkLen) TimeoutManager() {
 	ticker := time.NewTicker(time.Second * 10)
 	// Check if any new keys should be cleared set by l.NextClear.Timeout
 	timer := time.NewTimer(time.Second)
+	started.Done()
 	for {
 		// block until it is time to clear the next link or to check if l.NextClear has timed out every 10 seconds
 		select {
 		case <-ticker.C:
+			l.forgetGone()
 		case <-timer.C:
 		}
 		l.Mutex.RLock()
@@ -249,6 +577,7 @@ func (l *LinkLen) TimeoutManager() {
 				}
 			}
 			delete(l.LinkMap, keyToClear)
+			l.rememberGone(keyToClear, errLinkExpired)
 			if l.FreeMap != nil {
 				// Links of specific length
 				l.FreeMap[keyToClear] = true
@@ -269,3 +598,33 @@ func (l *LinkLen) TimeoutManager() {
 		l.Mutex.RUnlock()
 	}
 }
+
+// rememberGone remembers that key was removed with the user facing message msg, the caller must hold l.Mutex
+func (l *LinkLen) rememberGone(key, msg string) {
+	if rememberExpiredDuration() < 0 {
+		return
+	}
+	if l.Gone == nil {
+		l.Gone = make(map[string]goneLink)
+	}
+	l.Gone[key] = goneLink{Since: time.Now(), Message: msg}
+}
+
+// forgetGone removes the keys from l.Gone that were removed more than RememberExpiredDuration ago
+func (l *LinkLen) forgetGone() {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	for key, gone := range l.Gone {
+		if time.Since(gone.Since) > rememberExpiredDuration() {
+			delete(l.Gone, key)
+		}
+	}
+}
+
+// rememberExpiredDuration returns config.RememberExpiredDuration or the default if it is not set
+func rememberExpiredDuration() time.Duration {
+	if config.RememberExpiredDuration == 0 {
+		return defaultRememberExpired
+	}
+	return config.RememberExpiredDuration
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCountRead(t *testing.T) {
+	const domain = "times.test"
+	l := &LinkLen{Domain: domain}
+	l.LinkMap = make(map[string]*Link)
+	l.FreeMap = make(map[string]bool)
+
+	unlimited := &Link{Key: "a", Times: -1}
+	limited := &Link{Key: "b", Times: 3}
+	l.LinkMap["a"], l.LinkMap["b"] = unlimited, limited
+	l.NextClear, unlimited.NextClear, l.EndClear = unlimited, limited, limited
+
+	for i := 0; i < 5; i++ {
+		if ok, removed := l.countRead("a", unlimited); !ok || removed {
+			t.Fatalf("read %d of a link without xTimes was refused", i+1)
+		}
+	}
+
+	// three concurrent reads are allowed, the last one removes the link
+	var wg sync.WaitGroup
+	allowed, removed := make(chan bool, 5), make(chan bool, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, last := l.countRead("b", limited)
+			allowed <- ok
+			removed <- last
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+	close(removed)
+	n, last := 0, 0
+	for ok := range allowed {
+		if ok {
+			n++
+		}
+	}
+	for ok := range removed {
+		if ok {
+			last++
+		}
+	}
+	if n != 3 || last != 1 {
+		t.Errorf("%d reads were allowed and %d removed the link, want 3 and 1", n, last)
+	}
+	l.Mutex.RLock()
+	_, found := l.LinkMap["b"]
+	gone := l.Gone["b"].Message
+	l.Mutex.RUnlock()
+	if found || !l.FreeMap["b"] || gone != errLinkExpired {
+		t.Errorf("the link was not removed after the last read, found %v, free %v, gone %q", found, l.FreeMap["b"], gone)
+	}
+}
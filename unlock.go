@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// passwordHeader can be used by API clients to set the password of a new link, e.g. for quick add, or to unlock a link with a GET request
+	passwordHeader = "X-Link-Password"
+	// maxLinkPasswordLen is the longest accepted link password
+	maxLinkPasswordLen = 1024
+	// defaultUnlockMaxAttempts is used if UnlockMaxAttempts is not set
+	defaultUnlockMaxAttempts = 5
+	// defaultUnlockLockout is used if UnlockLockout is not set
+	defaultUnlockLockout = 15 * time.Minute
+)
+
+// unlockVars are the template variables of unlock.tmpl
+type unlockVars struct {
+	Domain string
+	// Key is the key of the protected link
+	Key string
+	// Error is the user facing error message of the previous attempt, it is translated in the template with .L.T
+	Error string
+	Site  *siteVars
+	L     *localizer
+}
+
+// linkPasswordHash returns the argon2id hash of the password sent with r in the form field password or the X-Link-Password header,
+// an empty hash is returned if no password was sent. The error is a user facing message, errServerBusy if other requests use all hash slots
+func linkPasswordHash(r *http.Request) (string, string) {
+	password := r.Header.Get(passwordHeader)
+	if r.Form != nil && r.Form.Get("password") != "" {
+		password = r.Form.Get("password")
+	}
+	if password == "" {
+		return "", ""
+	}
+	if len(password) > maxLinkPasswordLen {
+		return "", errPasswordTooLong
+	}
+	hash, err := tryHashPassword(password) // defined in credentials.go
+	if err == errHashBusy {
+		return "", errServerBusy
+	}
+	if err != nil {
+		if logger != nil {
+			logger.Println("Unable to hash link password:", err)
+		}
+		return "", errServerError
+	}
+	return hash, ""
+}
+
+// unlockMaxAttempts returns config.UnlockMaxAttempts or the default if it is not set
+func unlockMaxAttempts() int {
+	if config.UnlockMaxAttempts == 0 {
+		return defaultUnlockMaxAttempts
+	}
+	return config.UnlockMaxAttempts
+}
+
+// unlockLockout returns config.UnlockLockout or the default if it is not set
+func unlockLockout() time.Duration {
+	if config.UnlockLockout == 0 {
+		return defaultUnlockLockout
+	}
+	return config.UnlockLockout
+}
+
+// checkLinkPassword verifies password against the hash of lnk and counts failed attempts, once UnlockMaxAttempts wrong passwords have been
+// tried the link is locked for UnlockLockout and retryAfter is set. The attempts are counted per link so that guessing from many addresses is stopped as well.
+// An attempt is counted before the slow hash is computed so that parallel requests can not verify more than UnlockMaxAttempts passwords
+func checkLinkPassword(l *LinkLen, lnk *Link, password string) (ok bool, retryAfter time.Duration) {
+	if password == "" {
+		return false, 0
+	}
+	l.Mutex.Lock()
+	if wait := time.Until(lnk.lockedUntil); wait > 0 {
+		l.Mutex.Unlock()
+		return false, wait
+	}
+	if lnk.failedUnlocks >= unlockMaxAttempts() {
+		// the attempts in flight have used up the budget, lock the link until they are done
+		lnk.failedUnlocks = 0
+		lnk.lockedUntil = time.Now().Add(unlockLockout())
+		l.Mutex.Unlock()
+		return false, unlockLockout()
+	}
+	lnk.failedUnlocks++
+	l.Mutex.Unlock()
+
+	// the slow hash is verified without holding the lock
+	ok = verifyPassword(password, lnk.PasswordHash) // defined in credentials.go
+
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if ok {
+		lnk.failedUnlocks = 0
+		return true, 0
+	}
+	if lnk.failedUnlocks >= unlockMaxAttempts() && time.Until(lnk.lockedUntil) <= 0 {
+		lnk.failedUnlocks = 0
+		lnk.lockedUntil = time.Now().Add(unlockLockout())
+		if logger != nil {
+			logger.Println("Link", lnk.Key, "on", l.Domain, "locked after", unlockMaxAttempts(), "wrong passwords")
+		}
+		return false, unlockLockout()
+	}
+	return false, 0
+}
+
+// unlockLink returns true if r may access the password protected lnk, otherwise the request is answered with the unlock page for browsers
+// or an error for other clients. The password is taken from the form field password of a POST request or from the X-Link-Password header
+func unlockLink(w http.ResponseWriter, r *http.Request, l *LinkLen, lnk *Link, key string) bool {
+	if lnk.PasswordHash == "" {
+		return true
+	}
+	password := r.Header.Get(passwordHeader)
+	if r.Method == http.MethodPost {
+		password = r.PostFormValue("password")
+	}
+	if password == "" {
+		writeUnlockPage(w, r, key, "", http.StatusUnauthorized)
+		return false
+	}
+	ok, retryAfter := checkLinkPassword(l, lnk, password)
+	if ok {
+		return true
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		logErrors(w, r, errLinkLocked, http.StatusTooManyRequests, "")
+		return false
+	}
+	writeUnlockPage(w, r, key, errWrongPassword, http.StatusForbidden)
+	return false
+}
+
+// writeUnlockPage answers browsers with unlock.tmpl and all other clients with an error, errMsg is shown on the page if it is set
+func writeUnlockPage(w http.ResponseWriter, r *http.Request, key, errMsg string, statusCode int) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		if errMsg == "" {
+			errMsg = errPasswordRequired
+		}
+		logErrors(w, r, errMsg, statusCode, "")
+		return
+	}
+	t, ok := templateMap[r.Host+"#unlock"]
+	if !ok {
+		logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to load unlock template: "+r.Host+"#unlock")
+		return
+	}
+	vars := unlockVars{Domain: requestScheme(r) + "://" + r.Host, Key: key, Error: errMsg, Site: sites[r.Host], L: getLocalizer(r)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the unlock page is the answer to a request for the link, it must not be cached in place of the content
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := t.ExecuteTemplate(w, "unlock.tmpl", vars); err != nil && logger != nil {
+		logger.Println("ERROR executing template unlock.tmpl for host:", r.Host, "with the error:", err)
+	}
+	logOK(r, statusCode)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// expireHeader can be used instead of the query parameter expire to set the shortest lifetime of a plain upload, the keys of a length
+	// expire in the order they were added so a link can not expire earlier than the other links of its key length
+	expireHeader = "X-Expire"
+	// timesHeader can be used instead of the query parameter xTimes to limit how many times a plain upload can be read
+	timesHeader = "X-Times"
+	// expiresHeader is set in the plain answer to the time the link expires, expire is only the shortest lifetime so it can be later
+	expiresHeader = "X-Expires"
+)
+
+// plainUpload handles uploads from terminals that do not send the form of the index page, either the raw body, e.g.
+// curl --data-binary @file 7i.se, or a multipart form with a single field, e.g. cmd | curl -F 'f=<-' 7i.se. The text is added with the
+// shortest key length that has a free key and the answer is only the link. Returns false if the request is a normal form request
+func plainUpload(w http.ResponseWriter, r *http.Request) bool {
+	text, plain, errMsg := plainUploadText(r)
+	if !plain {
+		return false
+	}
+	if errMsg == "" && text == "" {
+		errMsg = errEmptyText
+	}
+	if errMsg == "" && int64(len(text)) > config.MaxFileSize {
+		errMsg = errTooLarge
+	}
+	if errMsg != "" {
+		logErrors(w, r, errMsg, statusFor(errMsg), "")
+		return true
+	}
+
+	expire, xTimes, lang, errMsg := plainUploadOptions(r)
+	if errMsg != "" {
+		logErrors(w, r, errMsg, statusFor(errMsg), "")
+		return true
+	}
+	if lowRAM() {
+		logErrors(w, r, errLowRAM, http.StatusServiceUnavailable, "")
+		return true
+	}
+	data, isCompressed := compressText(text) // defined in revisions.go
+
+	// the edit secret is only created for clients that get it in the JSON response, the plain answer is only the link
+	editSecret, editHash := "", ""
+	if strings.Contains(r.Header.Get("Accept"), "application/json") && maxRevisions() > 0 {
+		var err error
+		if editSecret, editHash, err = newEditSecret(); err != nil {
+			logErrors(w, r, errServerError, http.StatusInternalServerError, "Unable to create edit secret: "+url.QueryEscape(err.Error()))
+			return true
+		}
+	}
+
+	now := time.Now()
+	lnk := &Link{LinkType: "text", Data: data, IsCompressed: isCompressed, Times: xTimes, Language: lang, EditHash: editHash, Updated: now, Created: now}
+	key, err := addShortestText(r.Host, lnk, expire)
+	if err != nil {
+		addFailed(w, r, err) // defined in errors.go
+		return true
+	}
+	link := requestScheme(r) + "://" + r.Host + "/" + key
+	if writeCreated(w, r, createdResponse{URL: link, Expires: lnk.Timeout, EditSecret: editSecret}) { // defined in handlers.go
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// the body is only the link so that it can be used in scripts, the actual expiry is sent as a header
+	w.Header().Set(expiresHeader, lnk.Timeout.UTC().Format(time.RFC3339))
+	logOK(r, http.StatusOK)
+	fmt.Fprintln(w, link)
+	return true
+}
+
+// addShortestText adds lnk to the LinkLen of domain with the shortest keys that has a free key and keeps links at least expire, len 1 is
+// tried first, then len 2 and lastly len 3, the same order as quickAddURL. The timeout of lnk is set by the LinkLen that is used
+func addShortestText(domain string, lnk *Link, expire time.Duration) (key string, err error) {
+	// if no key length keeps links as long as requested
+	err = errors.New(errInvalidExpire)
+	for _, l := range []*LinkLen{&domainLinkLens[domain].LinkLen1, &domainLinkLens[domain].LinkLen2, &domainLinkLens[domain].LinkLen3} {
+		l.Mutex.RLock()
+		timeout := l.Timeout
+		l.Mutex.RUnlock()
+		if timeout < expire {
+			continue
+		}
+		lnk.Key = ""
+		lnk.Timeout = time.Now().Add(timeout)
+		if key, err = l.Add(lnk); err == nil {
+			return key, nil
+		}
+	}
+	return "", err
+}
+
+// plainUploadText returns the uploaded text of a plain upload, plain is false if r is a form with the field requestType or more than one
+// field that is handled as before. An error message is returned if the body can not be read
+func plainUploadText(r *http.Request) (text string, plain bool, errMsg string) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		// curl --data-binary sends application/x-www-form-urlencoded, the body is still used as is and never decoded
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", true, bodyErrMsg(err)
+		}
+		// unless it is an API call with requestType, e.g. curl -d 'requestType=url&url=...', which is parsed as a form by handleRequests
+		if mediaType == "application/x-www-form-urlencoded" {
+			if values, err := url.ParseQuery(string(body)); err == nil && values.Get("requestType") != "" {
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				if err := r.ParseForm(); err != nil {
+					return "", true, errInvalidRequest
+				}
+				return "", false, ""
+			}
+		}
+		return string(body), true, ""
+	}
+
+	// if it is not a plain upload handleRequests calls ParseMultipartForm again, which returns at once since the form is already parsed
+	if err := r.ParseMultipartForm(config.MaxFileSize); err != nil {
+		return "", true, bodyErrMsg(err)
+	}
+	form := r.MultipartForm
+	if r.PostForm.Get("requestType") != "" || len(form.Value)+len(form.File) != 1 {
+		return "", false, ""
+	}
+	for _, values := range form.Value {
+		if len(values) != 1 {
+			return "", false, ""
+		}
+		return values[0], true, ""
+	}
+	for _, files := range form.File {
+		if len(files) != 1 {
+			return "", false, ""
+		}
+		if files[0].Size > config.MaxFileSize {
+			return "", true, errTooLarge
+		}
+		f, err := files[0].Open()
+		if err != nil {
+			return "", true, errServerError
+		}
+		defer f.Close()
+		body, err := ioutil.ReadAll(f)
+		if err != nil {
+			return "", true, errServerError
+		}
+		return string(body), true, ""
+	}
+	return "", false, ""
+}
+
+// bodyErrMsg returns the error message for an error while reading the body of a request
+func bodyErrMsg(err error) string {
+	if strings.Contains(err.Error(), "request body too large") {
+		return errTooLarge
+	}
+	return errInvalidRequest
+}
+
+// plainUploadOptions returns the options of a plain upload from the query or the headers: the shortest lifetime of the link, how many times
+// it can be read and the language of the paste view. An error message is returned if an option is invalid
+func plainUploadOptions(r *http.Request) (expire time.Duration, xTimes int, lang, errMsg string) {
+	query := r.URL.Query()
+	if value := firstNonEmpty(query.Get("expire"), r.Header.Get(expireHeader)); value != "" {
+		var err error
+		if expire, err = time.ParseDuration(value); err != nil || expire < 0 {
+			return 0, 0, "", errInvalidExpire
+		}
+	}
+
+	// -1 represents no limit, the same as the form field xTimes
+	xTimes = -1
+	if value := firstNonEmpty(query.Get("xTimes"), r.Header.Get(timesHeader)); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			xTimes = n
+			if config.LinkAccessMaxNr > 0 && xTimes > config.LinkAccessMaxNr {
+				xTimes = config.LinkAccessMaxNr
+			}
+		}
+	}
+
+	lang = query.Get("lang")
+	if lang != "" && languages[lang] == nil { // defined in highlight.go
+		return 0, 0, "", errInvalidLanguage
+	}
+	return expire, xTimes, lang, ""
+}
+
+// firstNonEmpty returns the first value that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
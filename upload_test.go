@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// multipartRequest returns a POST request with a multipart form of fields and a file for every entry in files
+func multipartRequest(t *testing.T, fields, files map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		fw, err := mw.CreateFormFile(name, name+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// bodyRequest returns a POST request with body and the Content-Type contentType
+func bodyRequest(body, contentType string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	return r
+}
+
+func TestPlainUploadText(t *testing.T) {
+	defer func(size int64) { config.MaxFileSize = size }(config.MaxFileSize)
+	config.MaxFileSize = 1000
+
+	tests := []struct {
+		name   string
+		r      *http.Request
+		text   string
+		plain  bool
+		errMsg string
+	}{
+		{"raw body", bodyRequest("line 1\nline 2\n", "text/plain"), "line 1\nline 2\n", true, ""},
+		{"raw body without content type", bodyRequest("a=b", ""), "a=b", true, ""},
+		{"url encoded body is not decoded", bodyRequest("a+b=c%20d", "application/x-www-form-urlencoded"), "a+b=c%20d", true, ""},
+		{"url encoded form with requestType", bodyRequest("len=1&requestType=url&url=https://example.com", "application/x-www-form-urlencoded"), "", false, ""},
+		{"single multipart field", multipartRequest(t, map[string]string{"f": "hello"}, nil), "hello", true, ""},
+		{"single multipart file", multipartRequest(t, nil, map[string]string{"f": "file content"}), "file content", true, ""},
+		{"multipart file too large", multipartRequest(t, nil, map[string]string{"f": strings.Repeat("x", 1001)}), "", true, errTooLarge},
+		{"multipart form with requestType", multipartRequest(t, map[string]string{"requestType": "text"}, nil), "", false, ""},
+		{"more than one field", multipartRequest(t, map[string]string{"len": "1", "text": "hello"}, nil), "", false, ""},
+		{"a field and a file", multipartRequest(t, map[string]string{"len": "1"}, map[string]string{"f": "hello"}), "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, plain, errMsg := plainUploadText(tt.r)
+			if text != tt.text || plain != tt.plain || errMsg != tt.errMsg {
+				t.Errorf("plainUploadText() = %q, %v, %q, want %q, %v, %q", text, plain, errMsg, tt.text, tt.plain, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestPlainUploadTextParsesForm(t *testing.T) {
+	// the form of a url encoded API call is parsed so that handleRequests can read it after the body was consumed
+	r := bodyRequest("len=1&requestType=url&url=https://example.com", "application/x-www-form-urlencoded")
+	if _, plain, _ := plainUploadText(r); plain {
+		t.Fatal("a url encoded form with requestType is not a plain upload")
+	}
+	if got := r.Form.Get("url"); got != "https://example.com" {
+		t.Errorf("r.Form.Get(url) = %q, want https://example.com", got)
+	}
+	if err := r.ParseMultipartForm(1000); err != http.ErrNotMultipart {
+		t.Errorf("ParseMultipartForm() = %v, want %v", err, http.ErrNotMultipart)
+	}
+}
+
+func TestPlainUploadOptions(t *testing.T) {
+	defer func(max int) { config.LinkAccessMaxNr = max }(config.LinkAccessMaxNr)
+	config.LinkAccessMaxNr = 10
+
+	tests := []struct {
+		url     string
+		headers map[string]string
+		times   int
+		errMsg  string
+	}{
+		{"/", nil, -1, ""},
+		{"/?xTimes=3", nil, 3, ""},
+		{"/", map[string]string{timesHeader: "2"}, 2, ""},
+		{"/?xTimes=50", nil, 10, ""},
+		{"/?xTimes=0", nil, -1, ""},
+		{"/?xTimes=abc", nil, -1, ""},
+		{"/?expire=-1h", nil, 0, errInvalidExpire},
+		{"/?lang=nope", nil, 0, errInvalidLanguage},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.url, nil)
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		_, times, _, errMsg := plainUploadOptions(r)
+		if times != tt.times || errMsg != tt.errMsg {
+			t.Errorf("plainUploadOptions(%s, %v) = %d, %q, want %d, %q", tt.url, tt.headers, times, errMsg, tt.times, tt.errMsg)
+		}
+	}
+}